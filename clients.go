@@ -0,0 +1,139 @@
+package localstack
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// S3Client returns an S3 client configured to talk to localstack. Path-style addressing is used unless disabled with
+// WithS3PathStyle or WithS3VirtualHost, and the client targets the region given to WithS3Region if any.
+func (i *Instance) S3Client() *s3.Client {
+	cfg := i.Config()
+	cfg.Region = i.s3Region()
+
+	client := s3.New(cfg)
+	client.ForcePathStyle = !i.s3VirtualHost
+	return client
+}
+
+// DynamoStreamsClient returns a DynamoDB Streams client configured to talk to localstack. Streams are only served
+// when ServiceDynamoDBStreams is enabled.
+func (i *Instance) DynamoStreamsClient() *dynamodbstreams.Client {
+	return dynamodbstreams.New(i.Config())
+}
+
+// KinesisClient returns a Kinesis client configured to talk to localstack.
+func (i *Instance) KinesisClient() *kinesis.Client {
+	return kinesis.New(i.Config())
+}
+
+// WaitForStream waits for the named Kinesis stream to become ACTIVE. Streams start out CREATING, and localstack
+// rejects writes to them until they're active, which the default readiness check knows nothing about.
+func (i *Instance) WaitForStream(ctx context.Context, name string) error {
+	client := i.KinesisClient()
+	err := i.WaitForResource(ctx, func(ctx context.Context) (bool, error) {
+		res, err := client.DescribeStreamSummaryRequest(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String(name)}).Send(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		return res.StreamDescriptionSummary.StreamStatus == kinesis.StreamStatusActive, nil
+	})
+	if err != nil {
+		return fmt.Errorf("kinesis stream %s never became active: %w", name, err)
+	}
+
+	return nil
+}
+
+// SQSClient returns an SQS client configured to talk to localstack. Localstack builds queue URLs from its own idea of
+// its address, which rarely matches the randomly mapped host port, so the client rewrites the queue URLs it receives
+// to point at the Instance.
+func (i *Instance) SQSClient() *sqs.Client {
+	client := sqs.New(i.Config())
+	client.Handlers.Unmarshal.PushBack(func(r *aws.Request) {
+		switch out := r.Data.(type) {
+		case *sqs.CreateQueueOutput:
+			out.QueueUrl = i.rewriteQueueURL(out.QueueUrl)
+		case *sqs.GetQueueUrlOutput:
+			out.QueueUrl = i.rewriteQueueURL(out.QueueUrl)
+		case *sqs.ListQueuesOutput:
+			for idx, queueURL := range out.QueueUrls {
+				out.QueueUrls[idx] = aws.StringValue(i.rewriteQueueURL(&queueURL))
+			}
+		}
+	})
+
+	return client
+}
+
+// QueueURL points a queue URL returned by localstack at the Instance's sqs endpoint, keeping the queue's path.
+func (i *Instance) QueueURL(queueURL string) (string, error) {
+	endpoint, err := i.resolver("sqs", i.region)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := url.Parse(endpoint.URL)
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := url.Parse(queueURL)
+	if err != nil {
+		return "", err
+	}
+
+	parsed.Scheme = target.Scheme
+	parsed.Host = target.Host
+	if !strings.HasPrefix(parsed.Path, target.Path) {
+		parsed.Path = target.Path + parsed.Path
+	}
+
+	return parsed.String(), nil
+}
+
+// rewriteQueueURL is QueueURL for SDK outputs, leaving queue URLs it can't rewrite untouched.
+func (i *Instance) rewriteQueueURL(queueURL *string) *string {
+	if queueURL == nil {
+		return nil
+	}
+
+	rewritten, err := i.QueueURL(*queueURL)
+	if err != nil {
+		return queueURL
+	}
+
+	return aws.String(rewritten)
+}
+
+// CreateBucket creates a bucket in the S3 region. Only buckets outside of us-east-1 take a LocationConstraint, S3
+// rejects one naming us-east-1.
+func (i *Instance) CreateBucket(ctx context.Context, bucket string) error {
+	input := s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	if region := i.s3Region(); region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: s3.BucketLocationConstraint(region),
+		}
+	}
+
+	_, err := i.S3Client().CreateBucketRequest(&input).Send(ctx)
+	return err
+}
+
+// s3Region returns the region S3 clients use, which follows the Instance region unless overridden.
+func (i *Instance) s3Region() string {
+	if i.s3RegionName != "" {
+		return i.s3RegionName
+	}
+
+	return i.region
+}
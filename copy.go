@@ -0,0 +1,87 @@
+package localstack
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// CopyTo copies the file or directory at srcPath on the host to destPath in the container, which suits one-off
+// fixtures such as Lambda zips better than a bind mount. Parent directories of destPath must already exist.
+func (i *Instance) CopyTo(ctx context.Context, srcPath, destPath string) error {
+	if i.docker == nil || i.resource == nil || i.resource.Container == nil {
+		return errors.New("no localstack container to copy to")
+	}
+
+	if _, err := os.Stat(srcPath); err != nil {
+		return fmt.Errorf("failed to copy %s to localstack container: %w", srcPath, err)
+	}
+
+	// the archive is streamed as it's written so large fixtures aren't held in memory
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(writeTar(w, srcPath, path.Base(destPath)))
+	}()
+
+	err := i.docker.UploadToContainer(i.resource.Container.ID, docker.UploadToContainerOptions{
+		Context:     ctx,
+		InputStream: r,
+		Path:        path.Dir(destPath),
+	})
+	_ = r.Close()
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to localstack container: %w", srcPath, err)
+	}
+
+	return nil
+}
+
+// writeTar writes srcPath to w as a tar archive with its contents renamed to name.
+func writeTar(w io.Writer, srcPath, name string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(srcPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcPath, file)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = path.Join(name, filepath.ToSlash(rel))
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,81 @@
+package localstack
+
+import "encoding/json"
+
+// redacted replaces credentials in InstanceInfo.
+const redacted = "REDACTED"
+
+// InstanceInfo summarizes an Instance, which makes a handy addition to test failure messages.
+type InstanceInfo struct {
+	Image       string
+	Tag         string
+	Region      string
+	Services    []string
+	ContainerID string
+	Ports       map[string]string
+
+	// credentials are REDACTED when set so printing the InstanceInfo never leaks them
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Describe returns everything needed to reproduce the Instance's localstack setup.
+func (i *Instance) Describe() InstanceInfo {
+	tag := i.tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	var id string
+	if i.resource != nil && i.resource.Container != nil {
+		id = i.resource.Container.ID
+	}
+
+	return InstanceInfo{
+		Image:           i.repository(),
+		Tag:             tag,
+		Region:          i.region,
+		Services:        i.Services(),
+		ContainerID:     id,
+		Ports:           i.PortMap(),
+		AccessKeyID:     redact(i.key),
+		SecretAccessKey: redact(i.secret),
+		SessionToken:    redact(i.session),
+	}
+}
+
+// MarshalJSON encodes the InstanceInfo for CI artifacts. Credentials are redacted again in case the InstanceInfo
+// wasn't built by Describe, so the output is always safe to publish.
+func (info InstanceInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Image           string            `json:"image"`
+		Tag             string            `json:"tag"`
+		Region          string            `json:"region"`
+		Services        []string          `json:"services"`
+		ContainerID     string            `json:"containerId,omitempty"`
+		Ports           map[string]string `json:"ports"`
+		AccessKeyID     string            `json:"accessKeyId,omitempty"`
+		SecretAccessKey string            `json:"secretAccessKey,omitempty"`
+		SessionToken    string            `json:"sessionToken,omitempty"`
+	}{
+		Image:           info.Image,
+		Tag:             info.Tag,
+		Region:          info.Region,
+		Services:        info.Services,
+		ContainerID:     info.ContainerID,
+		Ports:           info.Ports,
+		AccessKeyID:     redact(info.AccessKeyID),
+		SecretAccessKey: redact(info.SecretAccessKey),
+		SessionToken:    redact(info.SessionToken),
+	})
+}
+
+// redact hides a credential while still showing whether it was set.
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return redacted
+}
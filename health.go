@@ -0,0 +1,107 @@
+package localstack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// healthPaths lists the health endpoints exposed by localstack, newest first.
+var healthPaths = []string{"/_localstack/health", "/health"}
+
+type healthResponse struct {
+	Services map[string]string `json:"services"`
+}
+
+// Health queries localstack's health endpoint and returns the reported status of each service, e.g. "running" or
+// "available". Only images with an edge port expose the endpoint.
+func (i *Instance) Health(ctx context.Context) (map[string]string, error) {
+	var err error
+	for _, path := range healthPaths {
+		var health map[string]string
+		if health, err = i.health(ctx, path); err == nil {
+			return health, nil
+		}
+	}
+
+	return nil, err
+}
+
+// RunningServices returns the sorted names of the services localstack's health endpoint reports as running or
+// available, which may differ from the enabled services if some failed to start.
+func (i *Instance) RunningServices(ctx context.Context) ([]string, error) {
+	health, err := i.Health(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var running []string
+	for service, status := range health {
+		if healthy(status) {
+			running = append(running, service)
+		}
+	}
+
+	sort.Strings(running)
+	return running, nil
+}
+
+func (i *Instance) health(ctx context.Context, path string) (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodGet, i.url(i.edgePort())+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := i.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("localstack health endpoint %s responded with %s", path, res.Status)
+	}
+
+	var body healthResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to parse localstack health response: %w", err)
+	}
+
+	return body.Services, nil
+}
+
+// healthReady considers localstack ready once the health endpoint reports every enabled service as running or
+// available.
+func healthReady(ctx context.Context, i *Instance) error {
+	health, err := i.Health(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range i.services {
+		if status := health[healthName(service)]; !healthy(status) {
+			return fmt.Errorf("localstack service %s is not ready: %q", service, status)
+		}
+	}
+
+	return nil
+}
+
+// healthy reports whether a health status means the service can take requests.
+func healthy(status string) bool {
+	return status == "running" || status == "available"
+}
+
+// healthName maps a service to the name localstack reports it under in health responses.
+func healthName(service string) string {
+	switch service {
+	case "streams.dynamodb":
+		return "dynamodbstreams"
+	case "elasticsearch":
+		return "es"
+	}
+
+	return service
+}
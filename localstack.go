@@ -1,33 +1,283 @@
 package localstack
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/defaults"
 	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/ory/dockertest"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
 )
 
 type serviceResolver func(service, region string) (aws.Endpoint, error)
 
+// dockerPool is the subset of *dockertest.Pool an Instance depends on, which lets tests substitute a fake for docker.
+type dockerPool interface {
+	RunWithOptions(opts *dockertest.RunOptions, hcOpts ...func(*docker.HostConfig)) (*dockertest.Resource, error)
+	Purge(r *dockertest.Resource) error
+}
+
+// dockerClient is the subset of *docker.Client an Instance uses directly, for the things dockertest doesn't wrap.
+type dockerClient interface {
+	InspectVolume(name string) (*docker.Volume, error)
+	RemoveVolumeWithOptions(opts docker.RemoveVolumeOptions) error
+	KillContainer(opts docker.KillContainerOptions) error
+	WaitContainerWithContext(id string, ctx context.Context) (int, error)
+	NetworkInfo(id string) (*docker.Network, error)
+	CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error)
+	RemoveNetwork(id string) error
+	ConnectNetwork(id string, opts docker.NetworkConnectionOptions) error
+	InspectContainer(id string) (*docker.Container, error)
+	InspectImage(name string) (*docker.Image, error)
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+	Logs(opts docker.LogsOptions) error
+	CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error)
+	StartExec(id string, opts docker.StartExecOptions) error
+	InspectExec(id string) (*docker.ExecInspect, error)
+	UploadToContainer(id string, opts docker.UploadToContainerOptions) error
+	Ping() error
+}
+
+const (
+	initialProbeDelay = 100 * time.Millisecond
+	maxProbeDelay     = 2 * time.Second
+	initialPullDelay  = time.Second
+	maxPullDelay      = 10 * time.Second
+	maxRunAttempts    = 3
+	// exitLogLines is how much of a crashed container's log is included in errors
+	exitLogLines = "20"
+
+	image             = "localstack/localstack"
+	proImage          = "localstack/localstack-pro"
+	containerDataDir  = "/tmp/localstack/data"
+	containerInitDir  = "/docker-entrypoint-initaws.d"
+	containerStateDir = "/var/lib/localstack/state"
+	virtualHostDomain = "s3.localhost.localstack.cloud"
+	attemptLabel      = "go-localstack.attempt"
+	dockerSocket      = "/var/run/docker.sock"
+	// every localstack tag is published for amd64
+	fallbackPlatform = "linux/amd64"
+)
+
+// A PortMode describes how localstack exposes its services on the container.
+type PortMode int
+
+const (
+	// PortModeEdge routes every service through the single edge port (4566) used by localstack 0.11 and newer.
+	PortModeEdge PortMode = iota + 1
+	// PortModeLegacy routes every service through its own dedicated port, as localstack did before 0.11.
+	PortModeLegacy
+)
+
+// containerName matches the names docker accepts for containers.
+var containerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// regions lists the AWS regions WithRandomRegion picks from.
+var regions = []string{
+	"us-east-1",
+	"us-east-2",
+	"us-west-1",
+	"us-west-2",
+	"ca-central-1",
+	"eu-west-1",
+	"eu-west-2",
+	"eu-west-3",
+	"eu-central-1",
+	"eu-north-1",
+	"ap-south-1",
+	"ap-northeast-1",
+	"ap-northeast-2",
+	"ap-southeast-1",
+	"ap-southeast-2",
+	"sa-east-1",
+}
+
+// A Service names an AWS service that localstack can run.
+type Service string
+
+// Services supported by localstack.
+const (
+	ServiceAPIGateway      Service = "apigateway"
+	ServiceKinesis         Service = "kinesis"
+	ServiceDynamoDB        Service = "dynamodb"
+	ServiceDynamoDBStreams Service = "streams.dynamodb"
+	ServiceElasticsearch   Service = "elasticsearch"
+	ServiceS3              Service = "s3"
+	ServiceFirehose        Service = "firehose"
+	ServiceLambda          Service = "lambda"
+	ServiceSNS             Service = "sns"
+	ServiceSQS             Service = "sqs"
+	ServiceRedshift        Service = "redshift"
+	ServiceES              Service = "es"
+	ServiceSES             Service = "ses"
+	ServiceRoute53         Service = "route53"
+	ServiceCloudFormation  Service = "cloudformation"
+	ServiceCloudWatch      Service = "cloudwatch"
+	ServiceSSM             Service = "ssm"
+	ServiceSecretsManager  Service = "secretsmanager"
+	ServiceLogs            Service = "logs"
+	ServiceEvents          Service = "events"
+	ServiceSTS             Service = "sts"
+	ServiceIAM             Service = "iam"
+	ServiceEC2             Service = "ec2"
+)
+
+const edgePort = "4566/tcp"
+
+// nativePlatforms maps host architectures to the platform of the localstack image built for them, for the
+// architectures where docker may otherwise pick an emulated one.
+var nativePlatforms = map[string]string{
+	"arm64": "linux/arm64",
+}
+
+// sdkServices maps the endpoint ids the SDK resolves under to the localstack service serving them, where they differ.
+var sdkServices = map[string]string{
+	"monitoring": "cloudwatch",
+	"email":      "ses",
+}
+
+// legacyPorts maps each supported service to the container port it listened on before the edge port existed.
+var legacyPorts = map[string]string{
+	"apigateway":       "4567/tcp",
+	"kinesis":          "4568/tcp",
+	"dynamodb":         "4569/tcp",
+	"streams.dynamodb": "4570/tcp",
+	"elasticsearch":    "4571/tcp",
+	"s3":               "4572/tcp",
+	"firehose":         "4573/tcp",
+	"lambda":           "4574/tcp",
+	"sns":              "4575/tcp",
+	"sqs":              "4576/tcp",
+	"redshift":         "4577/tcp",
+	"es":               "4578/tcp",
+	"ses":              "4579/tcp",
+	"route53":          "4580/tcp",
+	"cloudformation":   "4581/tcp",
+	"cloudwatch":       "4582/tcp",
+	"ssm":              "4583/tcp",
+	"secretsmanager":   "4584/tcp",
+	"logs":             "4586/tcp",
+	"events":           "4587/tcp",
+	"sts":              "4592/tcp",
+	"iam":              "4593/tcp",
+	"ec2":              "4597/tcp",
+	// "stepfunctions": "4585/tcp",
+}
+
+// ErrNoServices is returned from New when an Instance would run without any services.
+var ErrNoServices = errors.New("localstack instance has no services configured")
+
 // An Instance keeps track of the localstack container state.
 type Instance struct {
-	host     string
-	key      string
-	secret   string
-	session  string
-	region   string
+	host    string
+	prefix  string
+	key     string
+	secret  string
+	session string
+	region  string
+	signing string
+
 	services []string
+	image    string
+	tag      string
+	platform string
+	arch     string
+	name     string
+	network  string
+	aliases  []string
+	portMode PortMode
+	gateway  int
+	env      []string
+	mounts   []string
+	labels   map[string]string
+	hosts    []string
+	cmd      []string
+	fixed    map[string]string
+	custom   map[string]string
+	tweaks   []func(opts *dockertest.RunOptions)
+	auth     docker.AuthConfiguration
+	memory   int64
+	cpu      int64
+	hostNet  bool
+
+	randomRegion   bool
+	strict         bool
+	ssl            bool
+	s3VirtualHost  bool
+	s3Domain       string
+	cleanVolumes   bool
+	newVolumes     []string
+	external       bool
+	autoHost       bool
+	detectPorts    bool
+	skipS3         bool
+	readiness      string
+	readyLog       string
+	allServices    bool
+	snapshot       bool
+	amd64Fallback  bool
+	startupTimeout time.Duration
+	initTimeout    time.Duration
+	probeInterval  time.Duration
+	stopTimeout    time.Duration
+	retries        int
+	s3RegionName   string
+	servicesEnv    string
+	readyStreak    int
+	httpClient     *http.Client
+	logger         Logger
 
-	pool     *dockertest.Pool
+	pool     dockerPool
+	docker   dockerClient
 	resource *dockertest.Resource
 	resolver serviceResolver
+
+	// networkID is the network the container joined, which Close removes if ownNetwork is set
+	networkID  string
+	ownNetwork bool
+
+	// ports caches host ports by container port for the current resource
+	portsMu sync.Mutex
+	ports   map[string]string
+
+	timings       Timings
+	onTimings     func(Timings)
+	healthCheck   func(ctx context.Context, i *Instance) error
+	preStart      []func() error
+	startupHooks  []func(ctx context.Context, i *Instance) error
+	shutdownHooks []func(ctx context.Context, i *Instance) error
+	hooksDone     bool
+	probes        map[string]func(ctx context.Context, i *Instance) error
+	now           func() time.Time
+	sleep         func(d time.Duration)
 }
 
 // New spins up a new localstack container and returns an Instance tracking it.
@@ -40,31 +290,442 @@ func New(opts ...InstanceOpt) (*Instance, error) {
 		}
 	}
 
-	pool, err := dockertest.NewPool("")
+	if instance.pool == nil {
+		pool, err := dockertest.NewPool("")
+		if err != nil {
+			return nil, err
+		}
+
+		instance.pool = pool
+	}
+
+	endpoint := os.Getenv("DOCKER_HOST")
+	if pool, ok := instance.pool.(*dockertest.Pool); ok {
+		if instance.docker == nil {
+			instance.docker = pool.Client
+		}
+
+		endpoint = pool.Client.Endpoint()
+	}
+
+	if instance.autoHost && instance.host == "" {
+		instance.host = dockerHost(endpoint)
+	}
+
+	withDefaults(instance)
+	instance.normalizeServices()
+	if err := instance.validate(); err != nil {
+		return nil, err
+	}
+
+	if instance.allServices {
+		instance.logger.Logf("localstack instance enabling all %d services, which needs a lot of memory and CPU", len(instance.services))
+	}
+
+	// fail fast rather than waiting on the run retries when docker isn't around at all
+	if instance.docker != nil {
+		if err := instance.docker.Ping(); err != nil {
+			return nil, fmt.Errorf("docker is not running or can't be reached: %w", err)
+		}
+	}
+
+	for _, hook := range instance.preStart {
+		if err := hook(); err != nil {
+			return nil, fmt.Errorf("localstack pre-start hook failed: %w", err)
+		}
+	}
+
+	volumes, err := instance.createdVolumes()
+	if err != nil {
+		return nil, err
+	}
+	instance.newVolumes = volumes
+
+	if err := instance.joinNetwork(); err != nil {
+		return nil, err
+	}
+
+	started := instance.now()
+	resource, pulled, err := instance.start()
+	instance.timings.Pull = pulled
+	instance.timings.Start = instance.now().Sub(started) - pulled
 	if err != nil {
+		_ = instance.leaveNetwork()
+		return nil, err
+	}
+
+	instance.setResource(resource)
+	instance.detectPortMode()
+	if err := instance.connectNetwork(); err != nil {
+		_ = instance.Close()
+		return nil, err
+	}
+
+	if err := instance.finishStartup(); err != nil {
+		return nil, err
+	}
+
+	instance.reportTimings()
+	return instance, nil
+}
+
+// NewExternal returns an Instance for a localstack that's already running at host, e.g. a CI service container.
+// Every service is reached through the edge port, which defaults to 4566 when host doesn't include one. No container
+// is started or purged, so Close only runs shutdown hooks, and options that configure the container are rejected.
+func NewExternal(host string, opts ...InstanceOpt) (*Instance, error) {
+	instance := &Instance{external: true}
+
+	for _, opt := range opts {
+		if err := opt(instance); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := instance.checkExternal(); err != nil {
 		return nil, err
 	}
 
-	resource, err := pool.Run("localstack/localstack", "", []string{instance.serviceString()})
+	endpoint, port, err := splitHostPort(host)
 	if err != nil {
 		return nil, err
 	}
 
+	instance.host = endpoint
+	instance.portMode = PortModeEdge
+	instance.fixed = map[string]string{instance.edgePort(): port}
+
 	withDefaults(instance)
-	instance.resolver = instance.makeResolver()
-	instance.pool = pool
-	instance.resource = resource
+	instance.normalizeServices()
+	if err := instance.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := instance.finishStartup(); err != nil {
+		return nil, err
+	}
 
 	return instance, nil
 }
 
+// finishStartup finishes setting up an Instance once localstack is reachable, waiting for it when a startup timeout
+// is set.
+func (i *Instance) finishStartup() error {
+	i.resolver = i.makeResolver()
+
+	if i.randomRegion {
+		i.logger.Logf("localstack instance using random region %s", i.region)
+	}
+
+	// only worth the noise when the caller asked for logs
+	if _, ok := i.logger.(stdLogger); !ok {
+		i.logger.Logf("localstack instance using ports %v", i.PortMap())
+	}
+
+	if i.startupTimeout > 0 {
+		// New reports the timings once it's done, so this wait doesn't
+		if err := i.wait(i.startupTimeout); err != nil {
+			_ = i.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// start runs the container, giving up after the init timeout when one is set. A container that comes up after the
+// timeout is purged in the background so it doesn't leak.
+func (i *Instance) start() (*dockertest.Resource, time.Duration, error) {
+	if i.initTimeout <= 0 {
+		return i.run()
+	}
+
+	type result struct {
+		resource *dockertest.Resource
+		pulled   time.Duration
+		err      error
+	}
+
+	done := make(chan result)
+	timeout := time.NewTimer(i.initTimeout)
+	defer timeout.Stop()
+
+	abandoned := make(chan struct{})
+	go func() {
+		resource, pulled, err := i.run()
+		select {
+		case done <- result{resource, pulled, err}:
+		case <-abandoned:
+			if err == nil {
+				_ = i.pool.Purge(resource)
+			}
+		}
+	}()
+
+	select {
+	case res := <-done:
+		return res.resource, res.pulled, res.err
+	case <-timeout.C:
+		close(abandoned)
+		return nil, 0, fmt.Errorf("timed out after %s starting localstack container", i.initTimeout)
+	}
+}
+
+// run starts the localstack container. Docker occasionally hands out a host port that another container started
+// concurrently has just claimed, so port conflicts are retried with a fresh allocation. Pulls rejected by registry
+// rate limits are retried with a backoff.
+func (i *Instance) run() (*dockertest.Resource, time.Duration, error) {
+	delays := backoff{delay: initialPullDelay, max: maxPullDelay}
+
+	var pulled time.Duration
+	var err error
+	for attempt := 0; attempt < maxRunAttempts; attempt++ {
+		opts := i.runOptions()
+		token := labelAttempt(opts)
+
+		var elapsed time.Duration
+		elapsed, err = i.pull()
+		pulled += elapsed
+		if err == nil {
+			var resource *dockertest.Resource
+			if resource, err = i.pool.RunWithOptions(opts, i.hostConfig); err == nil {
+				return resource, pulled, nil
+			}
+		}
+
+		// dockertest leaves the container behind when it fails to start, e.g. on a port conflict
+		i.removeAttempt(token)
+
+		if isNameConflict(err) {
+			return nil, pulled, fmt.Errorf("a container named %q already exists, remove it or choose another name: %w", i.name, err)
+		}
+
+		if isAuthRequired(err) && i.auth == (docker.AuthConfiguration{}) {
+			return nil, pulled, fmt.Errorf("pulling the localstack image requires registry credentials, see WithRegistryAuth: %w", err)
+		}
+
+		switch {
+		case isPlatformMismatch(err) && i.amd64Fallback && i.platform != fallbackPlatform:
+			i.logger.Logf("localstack image has no native variant, retrying with %s: %s", fallbackPlatform, err)
+			i.platform = fallbackPlatform
+		case isPortConflict(err):
+			if port, ok := i.fixedPortConflict(err); ok {
+				return nil, pulled, fmt.Errorf("host port %s given to WithFixedPort is already in use: %w", port, err)
+			}
+		case isRateLimited(err):
+			if attempt < maxRunAttempts-1 {
+				i.sleep(delays.next())
+			}
+		default:
+			return nil, pulled, err
+		}
+	}
+
+	return nil, pulled, err
+}
+
+// pull pulls the image unless docker already has it for the requested platform, returning how long the pull took.
+// dockertest would pull it itself, but only when the tag is missing, so a cached image built for another platform
+// would run as-is. Doing it here also lets the pull be timed separately from starting the container.
+func (i *Instance) pull() (time.Duration, error) {
+	if i.docker == nil {
+		return 0, nil
+	}
+
+	tag := i.tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	ref := i.repository() + ":" + tag
+	cached, err := i.docker.InspectImage(ref)
+	if err == nil && hasPlatform(cached, i.platform) {
+		return 0, nil
+	}
+
+	if err == nil {
+		i.logger.Logf("cached image %s is %s/%s, pulling it for %s", ref, cached.OS, cached.Architecture, i.platform)
+	} else if !errors.Is(err, docker.ErrNoSuchImage) {
+		return 0, fmt.Errorf("failed to inspect image %s: %w", ref, err)
+	}
+
+	start := i.now()
+	err = i.docker.PullImage(docker.PullImageOptions{Repository: i.repository(), Tag: tag, Platform: i.platform}, i.auth)
+	return i.now().Sub(start), err
+}
+
+// hasPlatform reports whether image was built for platform, given as os/arch[/variant]. Any image matches when no
+// platform was requested, or when docker doesn't say what the image was built for. Docker doesn't report the variant,
+// so only the os and architecture are compared.
+func hasPlatform(image *docker.Image, platform string) bool {
+	if platform == "" || image.Architecture == "" {
+		return true
+	}
+
+	parts := strings.Split(platform, "/")
+	return image.OS == parts[0] && image.Architecture == parts[1]
+}
+
+func isRateLimited(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "toomanyrequests") || strings.Contains(msg, "rate limit")
+}
+
+func isAuthRequired(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unauthorized") ||
+		strings.Contains(msg, "authentication required") ||
+		strings.Contains(msg, "no basic auth credentials")
+}
+
+func isNameConflict(err error) bool {
+	return errors.Is(err, docker.ErrContainerAlreadyExists) || strings.Contains(err.Error(), "is already in use by container")
+}
+
+func isPlatformMismatch(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no matching manifest") || strings.Contains(msg, "does not match the specified platform")
+}
+
+func isPortConflict(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "port is already allocated") || strings.Contains(msg, "address already in use")
+}
+
+// labelAttempt tags the run options with a label unique to this run attempt and returns its value, so a container
+// left behind by a failed attempt can be found again.
+func labelAttempt(opts *dockertest.RunOptions) string {
+	labels := make(map[string]string, len(opts.Labels)+1)
+	for key, value := range opts.Labels {
+		labels[key] = value
+	}
+
+	token := strconv.FormatInt(rand.Int63(), 36) //nolint:gosec // the token only has to be unique among attempts
+	labels[attemptLabel] = token
+	opts.Labels = labels
+	return token
+}
+
+// removeAttempt removes any container created by the failed run attempt with the given token. Failures are only
+// logged, since the run error is the one worth returning.
+func (i *Instance) removeAttempt(token string) {
+	if i.docker == nil {
+		return
+	}
+
+	containers, err := i.docker.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {attemptLabel + "=" + token}},
+	})
+	if err != nil {
+		i.logger.Logf("failed to look up container from failed localstack run: %s", err)
+		return
+	}
+
+	for _, container := range containers {
+		err := i.docker.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true, RemoveVolumes: true})
+		if err != nil {
+			i.logger.Logf("failed to remove container %s from failed localstack run: %s", container.ID, err)
+		}
+	}
+}
+
+// fixedPortConflict returns the host port given to WithFixedPort that a port conflict is about, if any. Retrying
+// can't help there since the same port would be asked for again.
+func (i *Instance) fixedPortConflict(err error) (string, bool) {
+	msg := err.Error()
+	for _, hostPort := range i.fixed {
+		if strings.Contains(msg, ":"+hostPort+" ") || strings.Contains(msg, ":"+hostPort+":") {
+			return hostPort, true
+		}
+	}
+
+	return "", false
+}
+
+// NewWithCleanup is like New, but also returns a cleanup func that closes the Instance, which makes it convenient to
+// defer. Errors from Close are logged rather than returned. The cleanup func is never nil, so it's safe to defer even
+// when an error is returned.
+func NewWithCleanup(opts ...InstanceOpt) (*Instance, func(), error) {
+	instance, err := New(opts...)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	cleanup := func() {
+		if err := instance.Close(); err != nil {
+			instance.logger.Logf("failed to close localstack instance: %s", err)
+		}
+	}
+
+	return instance, cleanup, nil
+}
+
+// A Logger receives diagnostic messages from an Instance. *testing.T satisfies it.
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+// stdLogger is the default Logger, backed by the standard library's log package.
+type stdLogger struct{}
+
+func (stdLogger) Logf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+var (
+	sharedPool     *dockertest.Pool
+	sharedPoolErr  error
+	sharedPoolOnce sync.Once
+)
+
+// SharedPool returns a docker pool that's lazily created on first use and reused by every later call. Pass it to
+// WithPool to avoid opening a new docker connection for every Instance.
+func SharedPool() (*dockertest.Pool, error) {
+	sharedPoolOnce.Do(func() {
+		sharedPool, sharedPoolErr = dockertest.NewPool("")
+	})
+
+	return sharedPool, sharedPoolErr
+}
+
 // An InstanceOpt is a configuration option for the New constructor.
 type InstanceOpt func(instance *Instance) error
 
-// WithHost sets the Instance host value.
+// WithHost sets the Instance host value. Hosts without a scheme are assumed to be http and trailing slashes are
+// trimmed, so "localhost" and "http://localhost/" both become "http://localhost".
 func WithHost(host string) InstanceOpt {
 	return func(i *Instance) error {
-		i.host = host
+		normalized, err := normalizeHost(host)
+		if err != nil {
+			return err
+		}
+
+		i.host = normalized
+		return nil
+	}
+}
+
+// WithAutoHost points the Instance at the docker daemon's host rather than localhost, since that's where published
+// ports end up when DOCKER_HOST refers to a remote machine or VM. Local daemons reached over a socket still use
+// localhost. An explicit WithHost takes precedence.
+func WithAutoHost() InstanceOpt {
+	return func(i *Instance) error {
+		i.autoHost = true
+		return nil
+	}
+}
+
+// WithPathPrefix serves every endpoint under the given path, for setups where a proxy fronts localstack under a
+// subpath, e.g. http://proxy:8080/localstack.
+func WithPathPrefix(prefix string) InstanceOpt {
+	return func(i *Instance) error {
+		trimmed := strings.Trim(prefix, "/")
+		if trimmed == "" {
+			i.prefix = ""
+			return nil
+		}
+
+		i.prefix = "/" + trimmed
 		return nil
 	}
 }
@@ -79,6 +740,26 @@ func WithCredentials(key, secret, session string) InstanceOpt {
 	}
 }
 
+// WithCredentialsFromEnv takes credentials from the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN environment variables. Any that are unset keep their defaults.
+func WithCredentialsFromEnv() InstanceOpt {
+	return func(i *Instance) error {
+		if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+			i.key = key
+		}
+
+		if secret := os.Getenv("AWS_SECRET_ACCESS_KEY"); secret != "" {
+			i.secret = secret
+		}
+
+		if session := os.Getenv("AWS_SESSION_TOKEN"); session != "" {
+			i.session = session
+		}
+
+		return nil
+	}
+}
+
 // WithRegion sets the AWS region for the Instance.
 func WithRegion(region string) InstanceOpt {
 	return func(i *Instance) error {
@@ -87,228 +768,2160 @@ func WithRegion(region string) InstanceOpt {
 	}
 }
 
-// WithServices configures the Instance to only spin up the listed services.
-func WithServices(services ...string) InstanceOpt {
+// WithRandomRegion sets the AWS region for the Instance to one picked at random from a list of known regions, which is
+// useful for shaking out region sensitive code. The chosen region is logged and available from Region.
+func WithRandomRegion() InstanceOpt {
 	return func(i *Instance) error {
-		i.services = services
+		i.region = regions[rand.Intn(len(regions))] //nolint:gosec // region selection doesn't need a secure source
+		i.randomRegion = true
 		return nil
 	}
 }
 
-// Wait for localstack to be ready.
-func (i *Instance) Wait(max time.Duration) error {
-	s3Client := s3.New(i.Config())
-	start := time.Now()
-	input := s3.ListBucketsInput{}
-	for {
-		if _, err := s3Client.ListBucketsRequest(&input).Send(context.TODO()); err != nil {
-			if time.Now().Add(-1 * max).After(start) {
-				return errors.New("localstack failed to respond in time")
-			}
+// WithSigningRegion overrides the region requests are signed for independently of the client region, which is useful
+// when testing against S3's global endpoints. Defaults to the Instance region.
+func WithSigningRegion(region string) InstanceOpt {
+	return func(i *Instance) error {
+		i.signing = region
+		return nil
+	}
+}
 
-			time.Sleep(500 * time.Millisecond)
-			continue
+// WithServices configures the Instance to only spin up the listed services. New rejects services localstack doesn't
+// support, unless WithPortOverrides gives them a port.
+func WithServices(services ...Service) InstanceOpt {
+	return func(i *Instance) error {
+		names := make([]string, 0, len(services))
+		for _, service := range services {
+			names = append(names, strings.ToLower(strings.TrimSpace(string(service))))
 		}
 
+		i.services = names
+		i.servicesEnv = ""
 		return nil
 	}
 }
 
-// Close the Instance and clean up docker artifacts.
-func (i *Instance) Close() error {
-	return i.pool.Purge(i.resource)
-}
+// WithAllServices enables every service localstack can be resolved for. That's a lot of services, so reserve it for
+// broad integration suites.
+func WithAllServices() InstanceOpt {
+	return func(i *Instance) error {
+		services := make([]string, 0, len(legacyPorts))
+		for service := range legacyPorts {
+			services = append(services, service)
+		}
 
-func withDefaults(i *Instance) {
-	if i.host == "" {
-		i.host = "http://localhost"
+		sort.Strings(services)
+		i.services = services
+		i.servicesEnv = ""
+		i.allServices = true
+		return nil
 	}
+}
 
-	if i.region == "" {
-		i.region = "us-east-1"
-	}
+// WithServicesFromEnv enables the comma separated services listed in the named environment variable, so the same
+// test binary can run lean or full depending on where it runs. The services are left alone when the variable is
+// unset or empty.
+func WithServicesFromEnv(name string) InstanceOpt {
+	return func(i *Instance) error {
+		value := strings.TrimSpace(os.Getenv(name))
+		if value == "" {
+			return nil
+		}
 
-	if i.key == "" {
-		i.key = "key"
-	}
+		var services []Service
+		for _, service := range strings.Split(value, ",") {
+			if service = strings.TrimSpace(service); service != "" {
+				services = append(services, Service(service))
+			}
+		}
 
-	if i.secret == "" {
-		i.secret = "secret"
+		if err := WithServices(services...)(i); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+
+		i.servicesEnv = name
+		return nil
 	}
+}
 
-	if i.session == "" {
-		i.session = "session"
+// WithoutForcedS3 stops s3 from being enabled alongside the configured services. The s3 based readiness probe used
+// in PortModeLegacy won't work without it, so pair it with WithHealthCheck there.
+func WithoutForcedS3() InstanceOpt {
+	return func(i *Instance) error {
+		i.skipS3 = true
+		return nil
 	}
 }
 
-func (i *Instance) serviceString() string {
-	foundS3 := false
-	for _, service := range i.services {
-		if service == "s3" {
-			foundS3 = true
+// WithEnv sets an environment variable on the localstack container. The SERVICES variable is managed by
+// WithServices and can't be overridden this way.
+func WithEnv(key, value string) InstanceOpt {
+	return func(i *Instance) error {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid environment variable name %q", key)
 		}
-	}
 
-	// s3 always has to be available in order for Wait() to work.
-	if !foundS3 {
-		i.services = append(i.services, "s3")
+		if key == "SERVICES" {
+			return errors.New("use WithServices to configure SERVICES")
+		}
+
+		i.setEnv(key, value)
+		return nil
 	}
+}
 
+// WithOSEnvPassthrough copies the named variables from the test process's environment into the container's. Variables
+// that aren't set are skipped.
+func WithOSEnvPassthrough(names ...string) InstanceOpt {
+	return func(i *Instance) error {
+		for _, name := range names {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+
+			if err := WithEnv(name, value)(i); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// WithEnvFile adds the variables in a dotenv style file to the container's environment. Blank lines, # comments, and
+// export prefixes are allowed, and quoted values are unquoted. SERVICES is ignored in favor of WithServices.
+func WithEnvFile(path string) InstanceOpt {
+	return func(i *Instance) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open env file: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+
+			key, value, ok := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+			if !ok {
+				return fmt.Errorf("%s:%d: expected KEY=VALUE, got %q", path, line, text)
+			}
+
+			key = strings.TrimSpace(key)
+			if key == "SERVICES" {
+				continue
+			}
+
+			if err := WithEnv(key, unquote(strings.TrimSpace(value)))(i); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read env file: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// unquote strips a matching pair of single or double quotes from value.
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
+
+// WithDebug enables localstack's verbose debug logging.
+func WithDebug() InstanceOpt {
+	return WithEnv("DEBUG", "1")
+}
+
+// WithHostnameExternal sets the hostname localstack embeds in the URLs it hands out, such as SQS queue URLs and S3
+// notification targets, so they point somewhere the test process can reach.
+func WithHostnameExternal(host string) InstanceOpt {
+	return func(i *Instance) error {
+		if host == "" {
+			return errors.New("external hostname must not be empty")
+		}
+
+		i.setEnv("HOSTNAME_EXTERNAL", host)
+		return nil
+	}
+}
+
+// WithProxy passes proxy settings to the container for its outbound calls, such as downloading lambda layers. Empty
+// values are skipped. Image pulls go through the docker daemon, which needs its own proxy configuration.
+func WithProxy(httpProxy, httpsProxy, noProxy string) InstanceOpt {
+	return func(i *Instance) error {
+		for _, proxy := range [][2]string{{"HTTP_PROXY", httpProxy}, {"HTTPS_PROXY", httpsProxy}, {"NO_PROXY", noProxy}} {
+			if proxy[1] == "" {
+				continue
+			}
+
+			// some tools only read the lowercase variants
+			i.setEnv(proxy[0], proxy[1])
+			i.setEnv(strings.ToLower(proxy[0]), proxy[1])
+		}
+
+		return nil
+	}
+}
+
+// WithEagerServices makes localstack start every enabled service with the container instead of on first use, so
+// the first request in a test isn't slowed down by a service spinning up after Wait returned.
+func WithEagerServices() InstanceOpt {
+	return WithEnv("EAGER_SERVICE_LOADING", "1")
+}
+
+// WithDataDir bind-mounts the host directory at path into the container and points localstack's DATA_DIR at it, so
+// state written by one instance can be picked up by the next.
+func WithDataDir(path string) InstanceOpt {
+	return func(i *Instance) error {
+		i.setEnv("DATA_DIR", containerDataDir)
+		i.mounts = append(i.mounts, fmt.Sprintf("%s:%s", path, containerDataDir))
+		return nil
+	}
+}
+
+// WithInitScripts bind-mounts the host directory hostDir into /docker-entrypoint-initaws.d. Localstack runs the
+// scripts found there on startup, which is a convenient way to pre-create buckets, queues, and tables.
+func WithInitScripts(hostDir string) InstanceOpt {
+	return func(i *Instance) error {
+		info, err := os.Stat(hostDir)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("init scripts path %q is not a directory", hostDir)
+		}
+
+		i.mounts = append(i.mounts, fmt.Sprintf("%s:%s", hostDir, containerInitDir))
+		return nil
+	}
+}
+
+// WithLabels applies docker labels to the localstack container, e.g. so CI tooling can find and reap orphaned
+// containers. Labels from repeated calls are merged.
+func WithLabels(labels map[string]string) InstanceOpt {
+	return func(i *Instance) error {
+		if i.labels == nil {
+			i.labels = make(map[string]string, len(labels))
+		}
+
+		for key, value := range labels {
+			i.labels[key] = value
+		}
+		return nil
+	}
+}
+
+// WithMemory limits the memory available to the localstack container, in bytes.
+func WithMemory(bytes int64) InstanceOpt {
+	return func(i *Instance) error {
+		if bytes <= 0 {
+			return errors.New("memory limit must be positive")
+		}
+
+		i.memory = bytes
+		return nil
+	}
+}
+
+// WithCPUShares sets the relative CPU weight of the localstack container. Docker's default weight is 1024.
+func WithCPUShares(shares int64) InstanceOpt {
+	return func(i *Instance) error {
+		if shares <= 0 {
+			return errors.New("cpu shares must be positive")
+		}
+
+		i.cpu = shares
+		return nil
+	}
+}
+
+// WithHostNetwork runs the localstack container on the host network, which simplifies connectivity for containers
+// localstack launches itself (e.g. lambdas). Services are then reached on their container ports directly.
+func WithHostNetwork() InstanceOpt {
+	return func(i *Instance) error {
+		i.hostNet = true
+		return nil
+	}
+}
+
+// WithLambdaExecutor sets how localstack runs lambdas: "local", "docker", or "docker-reuse". The docker executors
+// launch sibling containers, so the docker socket is mounted into the localstack container for them.
+func WithLambdaExecutor(mode string) InstanceOpt {
+	return func(i *Instance) error {
+		switch mode {
+		case "local":
+		case "docker", "docker-reuse":
+			i.mounts = append(i.mounts, fmt.Sprintf("%s:%s", dockerSocket, dockerSocket))
+		default:
+			return fmt.Errorf("unknown lambda executor %q", mode)
+		}
+
+		i.setEnv("LAMBDA_EXECUTOR", mode)
+		return nil
+	}
+}
+
+// WithExtraHosts adds host to IP mappings to the container's /etc/hosts, like docker's --add-host. Entries take the
+// form "host:ip", e.g. "host.docker.internal:host-gateway".
+func WithExtraHosts(entries ...string) InstanceOpt {
+	return func(i *Instance) error {
+		for _, entry := range entries {
+			parts := strings.SplitN(entry, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return fmt.Errorf("invalid extra host %q, expected host:ip", entry)
+			}
+		}
+
+		i.hosts = append(i.hosts, entries...)
+		return nil
+	}
+}
+
+// WithNetwork attaches the container to the named docker network so other containers on it can reach localstack. The
+// network is created if it doesn't exist, in which case Close removes it again.
+func WithNetwork(name string) InstanceOpt {
+	return func(i *Instance) error {
+		if name == "" {
+			return errors.New("network name must not be empty")
+		}
+
+		i.network = name
+		return nil
+	}
+}
+
+// WithNetworkAlias gives the container an extra DNS name on the network set with WithNetwork, so peers can reach it at
+// e.g. http://alias:4566. It can be given multiple times.
+func WithNetworkAlias(alias string) InstanceOpt {
+	return func(i *Instance) error {
+		if alias == "" {
+			return errors.New("network alias must not be empty")
+		}
+
+		i.aliases = append(i.aliases, alias)
+		return nil
+	}
+}
+
+// WithHostGateway makes host.docker.internal resolve to the docker host from inside the container, which Docker
+// Desktop does by default but Linux doesn't. Localstack needs it to call back to the host for things like SNS HTTP
+// subscriptions and lambdas.
+func WithHostGateway() InstanceOpt {
+	return WithExtraHosts("host.docker.internal:host-gateway")
+}
+
+// WithCmd runs the given command in the localstack container instead of the image's default. This bypasses the
+// image entrypoint entirely, so the command is responsible for starting localstack itself, e.g. from a wrapper script.
+func WithCmd(cmd ...string) InstanceOpt {
+	return func(i *Instance) error {
+		if len(cmd) == 0 || cmd[0] == "" {
+			return errors.New("command must not be empty")
+		}
+
+		i.cmd = cmd
+		return nil
+	}
+}
+
+// WithFixedPort publishes containerPort on a fixed hostPort instead of a random one, for tools that expect localstack
+// at a well known address such as localhost:4566. It can be given multiple times.
+func WithFixedPort(containerPort, hostPort int) InstanceOpt {
+	return func(i *Instance) error {
+		if containerPort <= 0 || containerPort > 65535 || hostPort <= 0 || hostPort > 65535 {
+			return fmt.Errorf("invalid port binding %d:%d", hostPort, containerPort)
+		}
+
+		if i.fixed == nil {
+			i.fixed = make(map[string]string)
+		}
+
+		i.fixed[fmt.Sprintf("%d/tcp", containerPort)] = strconv.Itoa(hostPort)
+		return nil
+	}
+}
+
+// WithPortOverrides maps services to the container ports they listen on, for localstack builds whose ports don't
+// match the built-in table. Ports may be given as "4572" or "4572/tcp". Overridden ports are used in every PortMode
+// and are exposed on the container, since the image may not expose them itself.
+func WithPortOverrides(ports map[Service]string) InstanceOpt {
+	return func(i *Instance) error {
+		if i.custom == nil {
+			i.custom = make(map[string]string, len(ports))
+		}
+
+		for service, port := range ports {
+			port = strings.TrimSuffix(strings.TrimSpace(port), "/tcp")
+			if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("invalid port %q for service %q", ports[service], service)
+			}
+
+			i.custom[strings.ToLower(strings.TrimSpace(string(service)))] = port + "/tcp"
+		}
+
+		return nil
+	}
+}
+
+// WithStopTimeout makes Close send localstack SIGTERM before purging the container, waiting up to d for it to exit,
+// so localstack gets a chance to flush state such as persistence. It never speeds up teardown: without it the purge
+// force-removes the container straight away, and with it Close can take up to d longer.
+func WithStopTimeout(d time.Duration) InstanceOpt {
+	return func(i *Instance) error {
+		if d <= 0 {
+			return errors.New("stop timeout must be positive")
+		}
+
+		i.stopTimeout = d
+		return nil
+	}
+}
+
+// WithCleanVolumes makes Close remove the named volumes docker created for the container, e.g. ones mounted through
+// WithRunOptions that didn't exist before New. Anonymous volumes are removed along with the container even without
+// it. Volumes that already existed and bind mounts such as WithDataDir are left alone.
+func WithCleanVolumes() InstanceOpt {
+	return func(i *Instance) error {
+		i.cleanVolumes = true
+		return nil
+	}
+}
+
+// WithSnapshot starts localstack from the persistence snapshot saved in hostDir, so tests begin from a known captured
+// state. The container doesn't save its state back, which keeps the snapshot unchanged between runs. Loading
+// snapshots is a localstack pro feature, so WithProToken is required.
+func WithSnapshot(hostDir string) InstanceOpt {
+	return func(i *Instance) error {
+		info, err := os.Stat(hostDir)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("snapshot path %q is not a directory", hostDir)
+		}
+
+		i.snapshot = true
+		i.setEnv("PERSISTENCE", "1")
+		i.setEnv("SNAPSHOT_LOAD_STRATEGY", "ON_STARTUP")
+		i.setEnv("SNAPSHOT_SAVE_STRATEGY", "MANUAL")
+		i.mounts = append(i.mounts, fmt.Sprintf("%s:%s", hostDir, containerStateDir))
+		return nil
+	}
+}
+
+// WithPersistence toggles localstack's PERSISTENCE setting, which saves and restores state across restarts.
+func WithPersistence(enabled bool) InstanceOpt {
+	return func(i *Instance) error {
+		if enabled {
+			i.setEnv("PERSISTENCE", "1")
+		} else {
+			i.setEnv("PERSISTENCE", "0")
+		}
+		return nil
+	}
+}
+
+// WithProToken runs the LocalStack Pro image authenticated with the given token, enabling Pro-only services.
+func WithProToken(token string) InstanceOpt {
+	return func(i *Instance) error {
+		if token == "" {
+			return errors.New("localstack pro token must not be empty")
+		}
+
+		i.image = proImage
+		i.setEnv("LOCALSTACK_AUTH_TOKEN", token)
+		// older pro images only understand the api key variable
+		i.setEnv("LOCALSTACK_API_KEY", token)
+		return nil
+	}
+}
+
+// WithStartupTimeout makes New wait up to d for localstack to become ready before returning, so callers don't need
+// to call Wait themselves. If localstack isn't ready in time, the container is cleaned up and New returns an error.
+func WithStartupTimeout(d time.Duration) InstanceOpt {
+	return func(i *Instance) error {
+		if d <= 0 {
+			return errors.New("startup timeout must be positive")
+		}
+
+		i.startupTimeout = d
+		return nil
+	}
+}
+
+// WithReadyStreak makes Wait require n consecutive successful probes before considering localstack ready, which
+// rides out services that flap while they lazily initialize.
+func WithReadyStreak(n int) InstanceOpt {
+	return func(i *Instance) error {
+		if n < 1 {
+			return errors.New("ready streak must be at least 1")
+		}
+
+		i.readyStreak = n
+		return nil
+	}
+}
+
+// WithStartupProbeInterval makes Wait and WaitForServices probe every d instead of backing off exponentially.
+func WithStartupProbeInterval(d time.Duration) InstanceOpt {
+	return func(i *Instance) error {
+		if d <= 0 {
+			return errors.New("startup probe interval must be positive")
+		}
+
+		i.probeInterval = d
+		return nil
+	}
+}
+
+// WithInitTimeout bounds how long New waits for docker to pull the image and start the container. It's separate
+// from WithStartupTimeout, which only starts counting once the container is running, so a slow pull doesn't eat
+// into the time services get to become ready.
+func WithInitTimeout(d time.Duration) InstanceOpt {
+	return func(i *Instance) error {
+		if d <= 0 {
+			return errors.New("init timeout must be positive")
+		}
+
+		i.initTimeout = d
+		return nil
+	}
+}
+
+// WithSSL makes localstack serve HTTPS and points the resolver at https endpoints. Unless WithHTTPClient is used,
+// Config skips certificate verification since localstack serves a self-signed certificate.
+func WithSSL() InstanceOpt {
+	return func(i *Instance) error {
+		i.ssl = true
+		return nil
+	}
+}
+
+// WithS3PathStyle sets whether the client from S3Client uses path-style addressing. Defaults to true, which is what
+// localstack on localhost requires. Disable it to test virtual-hosted-style addressing.
+func WithS3PathStyle(enabled bool) InstanceOpt {
+	return func(i *Instance) error {
+		i.s3VirtualHost = !enabled
+		return nil
+	}
+}
+
+// WithS3VirtualHost tests virtual-hosted-style S3 addressing, where the bucket is part of the hostname. S3 endpoints
+// use s3.localhost.localstack.cloud, whose public DNS resolves it and every subdomain to 127.0.0.1, and S3Client
+// stops forcing path-style. It needs a docker daemon on the local machine and working DNS, which sandboxed CI
+// runners may not have.
+func WithS3VirtualHost() InstanceOpt {
+	return func(i *Instance) error {
+		i.s3VirtualHost = true
+		i.s3Domain = virtualHostDomain
+		return nil
+	}
+}
+
+// WithS3Region makes S3Client and CreateBucket use region instead of the Instance region, for tests covering S3's
+// regional quirks such as LocationConstraint.
+func WithS3Region(region string) InstanceOpt {
+	return func(i *Instance) error {
+		if region == "" {
+			return errors.New("s3 region must not be empty")
+		}
+
+		i.s3RegionName = region
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used by the AWS config returned from Config, e.g. to configure proxies, TLS,
+// timeouts, or request tracing.
+func WithHTTPClient(client *http.Client) InstanceOpt {
+	return func(i *Instance) error {
+		i.httpClient = client
+		return nil
+	}
+}
+
+// WithImage sets the localstack image repository to run, e.g. a mirror in a private registry. Defaults to
+// localstack/localstack. Pass it after WithProToken to mirror the pro image.
+func WithImage(repository string) InstanceOpt {
+	return func(i *Instance) error {
+		if repository == "" {
+			return errors.New("image repository must not be empty")
+		}
+
+		i.image = repository
+		return nil
+	}
+}
+
+// WithName gives the container a fixed name, which makes it easy to find in docker ps while debugging. Only one
+// container can have a given name, so avoid it for tests that run in parallel.
+func WithName(name string) InstanceOpt {
+	return func(i *Instance) error {
+		if !containerName.MatchString(name) {
+			return fmt.Errorf("invalid container name %q", name)
+		}
+
+		i.name = name
+		return nil
+	}
+}
+
+// WithPlatform pulls and runs the localstack image for the given platform, e.g. "linux/amd64" to force an Intel-only
+// tag on an arm64 host. A cached image built for another platform is pulled again, which retags it for this one. Without it, the latest localstack image runs as linux/arm64 when the test process runs on
+// arm64, unless WithImage points elsewhere.
+func WithPlatform(platform string) InstanceOpt {
+	return func(i *Instance) error {
+		parts := strings.Split(platform, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid platform %q, expected os/arch", platform)
+		}
+
+		i.platform = platform
+		return nil
+	}
+}
+
+// WithPlatformFallback retries with the linux/amd64 image when docker can't find one for the requested or native
+// platform, so tags without an arm64 variant still run under emulation on Apple Silicon.
+func WithPlatformFallback() InstanceOpt {
+	return func(i *Instance) error {
+		i.amd64Fallback = true
+		return nil
+	}
+}
+
+// WithRegistryAuth sets the credentials used to pull the localstack image from an authenticated registry.
+func WithRegistryAuth(username, password, server string) InstanceOpt {
+	return func(i *Instance) error {
+		i.auth = docker.AuthConfiguration{
+			Username:      username,
+			Password:      password,
+			ServerAddress: server,
+		}
+		return nil
+	}
+}
+
+// WithImageTag sets the localstack image tag to run. Defaults to latest.
+func WithImageTag(tag string) InstanceOpt {
+	return func(i *Instance) error {
+		i.tag = tag
+		return nil
+	}
+}
+
+// WithPortMode sets how the resolver maps services to container ports. When unset, the edge port is used if the
+// container publishes it and the legacy ports otherwise, falling back to a guess from the image tag.
+func WithPortMode(mode PortMode) InstanceOpt {
+	return func(i *Instance) error {
+		if mode != PortModeEdge && mode != PortModeLegacy {
+			return fmt.Errorf("unknown port mode %d", mode)
+		}
+
+		i.portMode = mode
+		return nil
+	}
+}
+
+// WithLogger sets where the Instance writes diagnostic messages. Defaults to the standard library's log package.
+func WithLogger(logger Logger) InstanceOpt {
+	return func(i *Instance) error {
+		i.logger = logger
+		return nil
+	}
+}
+
+// WithStrictResolver makes the resolver return an error for services localstack doesn't serve, instead of falling
+// back to the real AWS endpoints. This prevents tests from accidentally making live AWS calls.
+func WithStrictResolver() InstanceOpt {
+	return func(i *Instance) error {
+		i.strict = true
+		return nil
+	}
+}
+
+// WithGatewayPort moves localstack's edge gateway to a non-default container port and points the resolver at it.
+func WithGatewayPort(port int) InstanceOpt {
+	return func(i *Instance) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid gateway port %d", port)
+		}
+
+		i.gateway = port
+		i.setEnv("GATEWAY_LISTEN", fmt.Sprintf("0.0.0.0:%d", port))
+		// older images configure the edge port separately
+		i.setEnv("EDGE_PORT", strconv.Itoa(port))
+		return nil
+	}
+}
+
+// WithRetries configures the AWS config returned from Config to make up to maxAttempts attempts per request, which
+// smooths over transient errors from lazily started services.
+func WithRetries(maxAttempts int) InstanceOpt {
+	return func(i *Instance) error {
+		if maxAttempts < 1 {
+			return errors.New("max attempts must be at least 1")
+		}
+
+		i.retries = maxAttempts
+		return nil
+	}
+}
+
+// WithPool runs the Instance's container with an existing docker pool instead of creating a new one.
+func WithPool(pool *dockertest.Pool) InstanceOpt {
+	return func(i *Instance) error {
+		if pool == nil {
+			return errors.New("pool must not be nil")
+		}
+
+		i.pool = pool
+		return nil
+	}
+}
+
+// WithRunOptions lets fn change any of the options the container is run with, for docker settings without a
+// dedicated option. It runs after every other option has been applied, and can be given multiple times.
+func WithRunOptions(fn func(opts *dockertest.RunOptions)) InstanceOpt {
+	return func(i *Instance) error {
+		if fn == nil {
+			return errors.New("run options func must not be nil")
+		}
+
+		i.tweaks = append(i.tweaks, fn)
+		return nil
+	}
+}
+
+// WithStartupHook registers a hook that runs once localstack first becomes ready, e.g. to create baseline buckets or
+// queues. Hooks run in the order given from Wait, or from New when WithStartupTimeout is used, and a failing hook fails
+// the call that ran it.
+func WithStartupHook(hook func(ctx context.Context, i *Instance) error) InstanceOpt {
+	return func(i *Instance) error {
+		i.startupHooks = append(i.startupHooks, hook)
+		return nil
+	}
+}
+
+// Timings breaks down how long an Instance took to come up, to help track down slow suites.
+type Timings struct {
+	// Pull is how long pulling the image took. It's zero if docker already had it.
+	Pull time.Duration
+	// Start is how long docker took to create and start the container, not counting the pull.
+	Start time.Duration
+	// Wait is how long the last Wait, or the wait for WithStartupTimeout, took. It's zero if neither ran.
+	Wait time.Duration
+}
+
+// WithTimings calls fn with the Instance's Timings when New succeeds and after every Wait, whether or not localstack
+// became ready.
+func WithTimings(fn func(Timings)) InstanceOpt {
+	return func(i *Instance) error {
+		i.onTimings = fn
+		return nil
+	}
+}
+
+// reportTimings passes the current timings to the WithTimings callback, if any.
+func (i *Instance) reportTimings() {
+	if i.onTimings != nil {
+		i.onTimings(i.timings)
+	}
+}
+
+// WithPreStart runs fn in New before the container is started, e.g. to prepare mounted directories or create the
+// network given to WithNetwork. An error from fn aborts New. It can be given multiple times and hooks run in order.
+func WithPreStart(fn func() error) InstanceOpt {
+	return func(i *Instance) error {
+		i.preStart = append(i.preStart, fn)
+		return nil
+	}
+}
+
+// WithShutdownHook runs hook when the Instance is closed, before the container is purged, e.g. to export data or
+// capture the final logs. Hooks run in the order given, and their errors are returned from Close.
+func WithShutdownHook(hook func(ctx context.Context, i *Instance) error) InstanceOpt {
+	return func(i *Instance) error {
+		i.shutdownHooks = append(i.shutdownHooks, hook)
+		return nil
+	}
+}
+
+// WithReadinessService makes Wait probe the given service with a cheap list call instead of the default readiness
+// check, which avoids depending on s3 when another service is the one under test. The service must be enabled.
+func WithReadinessService(service Service) InstanceOpt {
+	return func(i *Instance) error {
+		name := strings.ToLower(strings.TrimSpace(string(service)))
+		if _, ok := serviceProbes[name]; !ok {
+			return fmt.Errorf("no readiness probe for service %q", service)
+		}
+
+		i.readiness = name
+		i.healthCheck = func(ctx context.Context, i *Instance) error {
+			return i.probes[name](ctx, i)
+		}
+		return nil
+	}
+}
+
+// WithReadyLog makes Wait hold off probing until the container logs the given line, e.g. "Ready.", which localstack
+// prints once its services are up. The probes still run afterwards, but usually pass on the first try.
+func WithReadyLog(substring string) InstanceOpt {
+	return func(i *Instance) error {
+		if substring == "" {
+			return errors.New("ready log line can't be empty")
+		}
+
+		i.readyLog = substring
+		return nil
+	}
+}
+
+// WithSeed runs seed once localstack is ready so tests can create their buckets, tables, and queues with the SDK
+// rather than init scripts. It's a startup hook, so an error from seed fails Wait, or New with WithStartupTimeout.
+func WithSeed(seed func(ctx context.Context, cfg aws.Config) error) InstanceOpt {
+	return WithStartupHook(func(ctx context.Context, i *Instance) error {
+		if err := seed(ctx, i.Config()); err != nil {
+			return fmt.Errorf("failed to seed localstack: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// WithHealthCheck replaces the default S3 readiness probe used by Wait and Ready. The check should return nil once
+// the services it cares about are ready.
+func WithHealthCheck(check func(ctx context.Context, i *Instance) error) InstanceOpt {
+	return func(i *Instance) error {
+		i.healthCheck = check
+		return nil
+	}
+}
+
+// Wait for localstack to be ready. Probes are retried with an exponential backoff until max has elapsed.
+func (i *Instance) Wait(max time.Duration) error {
+	defer i.reportTimings()
+	return i.wait(max)
+}
+
+func (i *Instance) wait(max time.Duration) error {
+	start := i.now()
+	defer func() {
+		i.timings.Wait = i.now().Sub(start)
+	}()
+
+	if i.readyLog != "" && i.docker != nil && i.resource != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), start.Add(max))
+		err := i.WaitForLog(ctx, i.readyLog)
+		cancel()
+		if err != nil {
+			return &TimeoutError{Elapsed: i.now().Sub(start), Err: err}
+		}
+	}
+
+	if err := i.poll(i.streak(i.healthCheck), start.Add(max)); err != nil {
+		return &TimeoutError{Elapsed: i.now().Sub(start), Err: err}
+	}
+
+	return i.runStartupHooks(context.TODO())
+}
+
+// WaitHealthy is like Wait, but also checks that the container is still running between probes. If localstack
+// crashed on boot it fails fast with the exit code and the tail of the container's log instead of timing out.
+func (i *Instance) WaitHealthy(ctx context.Context) error {
+	delays := backoff{delay: initialProbeDelay, max: maxProbeDelay}
+	check := i.streak(i.healthCheck)
+	for {
+		if err := i.checkRunning(ctx); err != nil {
+			return err
+		}
+
+		err := check(ctx, i)
+		if err == nil {
+			return i.runStartupHooks(ctx)
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("localstack failed to become healthy: %w: %s", ctxErr, err)
+		}
+
+		delay := i.probeInterval
+		if delay <= 0 {
+			delay = delays.next()
+		}
+
+		i.sleep(delay)
+	}
+}
+
+// checkRunning returns a descriptive error if the container has exited. Instances without a container are assumed to
+// be running.
+func (i *Instance) checkRunning(ctx context.Context) error {
+	if i.docker == nil || i.resource == nil || i.resource.Container == nil {
+		return nil
+	}
+
+	container, err := i.docker.InspectContainer(i.resource.Container.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect localstack container: %w", err)
+	}
+
+	if container.State.Running {
+		return nil
+	}
+
+	var logs strings.Builder
+	err = i.docker.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    container.ID,
+		OutputStream: &logs,
+		ErrorStream:  &logs,
+		Stdout:       true,
+		Stderr:       true,
+		Tail:         exitLogLines,
+	})
+	if err != nil {
+		return fmt.Errorf("localstack container exited with code %d", container.State.ExitCode)
+	}
+
+	return fmt.Errorf("localstack container exited with code %d:\n%s", container.State.ExitCode, strings.TrimSpace(logs.String()))
+}
+
+// Exec runs cmd inside the localstack container and returns what it wrote to stdout and stderr. It's handy for setup
+// that's easier with the awslocal CLI bundled in the image, e.g. Exec(ctx, "awslocal", "s3", "mb", "s3://bucket").
+// A non-zero exit code is returned as an error alongside the output.
+func (i *Instance) Exec(ctx context.Context, cmd ...string) (stdout, stderr string, err error) {
+	if len(cmd) == 0 {
+		return "", "", errors.New("command must not be empty")
+	}
+
+	if i.docker == nil || i.resource == nil || i.resource.Container == nil {
+		return "", "", errors.New("no localstack container to exec in")
+	}
+
+	exec, err := i.docker.CreateExec(docker.CreateExecOptions{
+		Context:      ctx,
+		Container:    i.resource.Container.ID,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create exec in localstack container: %w", err)
+	}
+
+	var out, errOut bytes.Buffer
+	err = i.docker.StartExec(exec.ID, docker.StartExecOptions{
+		Context:      ctx,
+		OutputStream: &out,
+		ErrorStream:  &errOut,
+	})
+	if err != nil {
+		return out.String(), errOut.String(), fmt.Errorf("failed to exec %q in localstack container: %w", cmd[0], err)
+	}
+
+	inspect, err := i.docker.InspectExec(exec.ID)
+	if err != nil {
+		return out.String(), errOut.String(), fmt.Errorf("failed to inspect exec in localstack container: %w", err)
+	}
+
+	if inspect.ExitCode != 0 {
+		return out.String(), errOut.String(), fmt.Errorf("%q exited with code %d", strings.Join(cmd, " "), inspect.ExitCode)
+	}
+
+	return out.String(), errOut.String(), nil
+}
+
+// WaitForLog follows the container's log until a line containing substring appears, the log ends because the
+// container stopped, or ctx is done.
+func (i *Instance) WaitForLog(ctx context.Context, substring string) error {
+	if i.docker == nil || i.resource == nil || i.resource.Container == nil {
+		return errors.New("no localstack container to read logs from")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	match := &logMatcher{substring: []byte(substring), found: cancel}
+	err := i.docker.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    i.resource.Container.ID,
+		OutputStream: match,
+		ErrorStream:  match,
+		Stdout:       true,
+		Stderr:       true,
+		Follow:       true,
+	})
+	if match.matched() {
+		return nil
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("localstack never logged %q: %w", substring, ctxErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to follow localstack logs: %w", err)
+	}
+
+	return fmt.Errorf("localstack log ended before %q appeared", substring)
+}
+
+// logMatcher is a log sink that calls found the first time substring is written. The tail of each write is kept so
+// a match split across writes isn't missed.
+type logMatcher struct {
+	substring []byte
+	found     func()
+
+	mu   sync.Mutex
+	tail []byte
+	done bool
+}
+
+func (m *logMatcher) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.done {
+		return len(p), nil
+	}
+
+	buf := append(m.tail, p...)
+	if bytes.Contains(buf, m.substring) {
+		m.done = true
+		m.found()
+		return len(p), nil
+	}
+
+	if keep := len(m.substring) - 1; len(buf) > keep {
+		buf = buf[len(buf)-keep:]
+	}
+
+	m.tail = append([]byte(nil), buf...)
+	return len(p), nil
+}
+
+func (m *logMatcher) matched() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.done
+}
+
+// streak wraps check so it only succeeds once it has passed the configured number of times in a row.
+func (i *Instance) streak(check func(ctx context.Context, i *Instance) error) func(ctx context.Context, i *Instance) error {
+	if i.readyStreak <= 1 {
+		return check
+	}
+
+	passes := 0
+	return func(ctx context.Context, i *Instance) error {
+		if err := check(ctx, i); err != nil {
+			passes = 0
+			return err
+		}
+
+		if passes++; passes < i.readyStreak {
+			return fmt.Errorf("localstack was ready %d of %d times in a row", passes, i.readyStreak)
+		}
+
+		return nil
+	}
+}
+
+// runStartupHooks runs the startup hooks the first time localstack is found to be ready.
+func (i *Instance) runStartupHooks(ctx context.Context) error {
+	if i.hooksDone {
+		return nil
+	}
+
+	for _, hook := range i.startupHooks {
+		if err := hook(ctx, i); err != nil {
+			return fmt.Errorf("localstack startup hook failed: %w", err)
+		}
+	}
+
+	i.hooksDone = true
+	return nil
+}
+
+// A TimeoutError is returned when localstack doesn't become ready in time. Err holds the last probe failure.
+type TimeoutError struct {
+	Elapsed time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("localstack failed to respond in time after %s: %s", e.Elapsed, e.Err)
+}
+
+// Unwrap returns the last probe failure.
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// WaitForServices waits for every service enabled on the Instance to respond, rather than just the one probed by
+// Wait. Services are probed concurrently and share the max deadline. Services without a known probe are assumed to
+// be ready. On timeout, the error joins the last probe error of each service that never responded.
+func (i *Instance) WaitForServices(max time.Duration) error {
+	deadline := i.now().Add(max)
+	errs := make(chan error, len(i.services))
+	for _, service := range i.services {
+		go func(service string) {
+			probe, ok := i.probes[service]
+			if !ok {
+				errs <- nil
+				return
+			}
+
+			if err := i.poll(probe, deadline); err != nil {
+				errs <- fmt.Errorf("%s: %w", service, err)
+				return
+			}
+
+			errs <- nil
+		}(service)
+	}
+
+	var failures []error
+	for range i.services {
+		if err := <-errs; err != nil {
+			failures = append(failures, err)
+		}
+	}
+
+	if len(failures) > 0 {
+		// errors are prefixed with their service, so this orders them by service
+		sort.Slice(failures, func(a, b int) bool {
+			return failures[a].Error() < failures[b].Error()
+		})
+
+		return fmt.Errorf("localstack services failed to respond in time: %w", errors.Join(failures...))
+	}
+
+	return nil
+}
+
+// poll runs check until it succeeds or the deadline passes, backing off between attempts. The last error from check
+// is returned on timeout.
+func (i *Instance) poll(check func(ctx context.Context, i *Instance) error, deadline time.Time) error {
+	delays := backoff{delay: initialProbeDelay, max: maxProbeDelay}
+	for {
+		// a probe stuck on a connection must not run past the deadline
+		ctx, cancel := context.WithTimeout(context.Background(), deadline.Sub(i.now()))
+		err := check(ctx, i)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		remaining := deadline.Sub(i.now())
+		if remaining <= 0 {
+			return err
+		}
+
+		delay := i.probeInterval
+		if delay <= 0 {
+			delay = delays.next()
+		}
+
+		if delay > remaining {
+			delay = remaining
+		}
+
+		i.sleep(delay)
+	}
+}
+
+// WaitForResource polls check until it reports true, which is useful for waiting on buckets, queues, or tables
+// created asynchronously by init scripts. Errors from check are treated as the resource not existing yet, since
+// that's how most AWS APIs report it. The last error is included if ctx is done first.
+func (i *Instance) WaitForResource(ctx context.Context, check func(ctx context.Context) (bool, error)) error {
+	delays := backoff{delay: initialProbeDelay, max: maxProbeDelay}
+	for {
+		ok, err := check(ctx)
+		if ok {
+			return nil
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err != nil {
+				return fmt.Errorf("localstack resource not found: %w: %s", ctxErr, err)
+			}
+
+			return fmt.Errorf("localstack resource not found: %w", ctxErr)
+		}
+
+		delay := i.probeInterval
+		if delay <= 0 {
+			delay = delays.next()
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && delay > deadline.Sub(i.now()) {
+			delay = deadline.Sub(i.now())
+		}
+
+		i.sleep(delay)
+	}
+}
+
+// Region returns the AWS region used by the Instance. Since defaults are applied by New, this is the effective region
+// even when WithRegion wasn't given.
+func (i *Instance) Region() string {
+	return i.region
+}
+
+// Services returns the normalized list of services the Instance runs, including any added by default.
+func (i *Instance) Services() []string {
+	services := make([]string, len(i.services))
+	copy(services, i.services)
+	return services
+}
+
+// PortMap returns the host port serving each enabled service, which is handy when diagnosing a failing test.
+func (i *Instance) PortMap() map[string]string {
+	ports := make(map[string]string, len(i.services))
+	for _, service := range i.services {
+		if port, ok := i.containerPort(service); ok {
+			ports[service] = i.publishedPort(port)
+		}
+	}
+
+	return ports
+}
+
+// Endpoint returns the URL the given service is reachable at.
+func (i *Instance) Endpoint(service Service) (string, error) {
+	endpoint, err := i.resolver(strings.ToLower(strings.TrimSpace(string(service))), i.region)
+	if err != nil {
+		return "", err
+	}
+
+	return endpoint.URL, nil
+}
+
+// Ready performs a single readiness probe and reports whether localstack responded. Unlike Wait, it never
+// retries or sleeps, which makes it a building block for custom wait loops.
+func (i *Instance) Ready(ctx context.Context) bool {
+	return i.healthCheck(ctx, i) == nil
+}
+
+// Close the Instance and clean up docker artifacts. Shutdown hooks run first, and the container is purged even if
+// one of them fails.
+func (i *Instance) Close() error {
+	hookErr := i.runShutdownHooks(context.TODO())
+	return errors.Join(hookErr, i.close())
+}
+
+func (i *Instance) close() error {
+	if i.external {
+		return nil
+	}
+
+	i.stop()
+	if err := i.pool.Purge(i.resource); err != nil {
+		return err
+	}
+
+	for _, name := range i.newVolumes {
+		err := i.docker.RemoveVolumeWithOptions(docker.RemoveVolumeOptions{Name: name})
+		if err != nil && !errors.Is(err, docker.ErrNoSuchVolume) {
+			return fmt.Errorf("failed to remove volume %s: %w", name, err)
+		}
+	}
+
+	if err := i.leaveNetwork(); err != nil {
+		return fmt.Errorf("failed to remove network %s: %w", i.network, err)
+	}
+
+	return nil
+}
+
+// runShutdownHooks runs every shutdown hook, joining their errors.
+func (i *Instance) runShutdownHooks(ctx context.Context) error {
+	var errs []error
+	for _, hook := range i.shutdownHooks {
+		if err := hook(ctx, i); err != nil {
+			errs = append(errs, fmt.Errorf("localstack shutdown hook failed: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// joinNetwork looks up the network given to WithNetwork, creating it if it doesn't exist yet.
+func (i *Instance) joinNetwork() error {
+	if i.network == "" {
+		return nil
+	}
+
+	if i.docker == nil {
+		return errors.New("WithNetwork requires a docker client")
+	}
+
+	network, err := i.docker.NetworkInfo(i.network)
+	var missing *docker.NoSuchNetwork
+	if errors.As(err, &missing) {
+		i.ownNetwork = true
+		network, err = i.docker.CreateNetwork(docker.CreateNetworkOptions{Name: i.network})
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to set up network %s: %w", i.network, err)
+	}
+
+	i.networkID = network.ID
+	return nil
+}
+
+// connectNetwork attaches the running container to the network set up by joinNetwork. It's connected after starting
+// since RunOptions can't carry network aliases.
+func (i *Instance) connectNetwork() error {
+	if i.networkID == "" {
+		return nil
+	}
+
+	err := i.docker.ConnectNetwork(i.networkID, docker.NetworkConnectionOptions{
+		Container:      i.resource.Container.ID,
+		EndpointConfig: &docker.EndpointConfig{Aliases: i.aliases},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to network %s: %w", i.network, err)
+	}
+
+	return nil
+}
+
+// leaveNetwork removes the network the Instance joined if it was created for the Instance. Networks that already
+// existed are left alone since other containers may be using them.
+func (i *Instance) leaveNetwork() error {
+	if !i.ownNetwork {
+		return nil
+	}
+
+	if err := i.docker.RemoveNetwork(i.networkID); err != nil {
+		var missing *docker.NoSuchNetwork
+		if !errors.As(err, &missing) {
+			return err
+		}
+	}
+
+	i.ownNetwork = false
+	return nil
+}
+
+// stop sends localstack SIGTERM and gives it the stop timeout to shut down cleanly before the container is purged,
+// which would otherwise kill it outright. docker's own stop sends the container's stop signal, which dockertest sets
+// to SIGWINCH and localstack ignores. Failures are only logged since the purge kills the container regardless.
+func (i *Instance) stop() {
+	if i.stopTimeout <= 0 || i.docker == nil || i.resource == nil || i.resource.Container == nil {
+		return
+	}
+
+	id := i.resource.Container.ID
+	err := i.docker.KillContainer(docker.KillContainerOptions{ID: id, Signal: docker.SIGTERM})
+
+	var notRunning *docker.ContainerNotRunning
+	if errors.As(err, &notRunning) {
+		return
+	}
+
+	if err != nil {
+		i.logger.Logf("failed to stop localstack container: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), i.stopTimeout)
+	defer cancel()
+
+	if _, err := i.docker.WaitContainerWithContext(id, ctx); err != nil {
+		if ctx.Err() != nil {
+			i.logger.Logf("localstack container didn't stop within %s, killing it", i.stopTimeout)
+			return
+		}
+
+		i.logger.Logf("failed to wait for localstack container to stop: %s", err)
+	}
+}
+
+// createdVolumes returns the named volumes mounted into the container that don't exist yet, which docker creates
+// when the container starts. Volumes that already exist belong to someone else and are left out.
+func (i *Instance) createdVolumes() ([]string, error) {
+	if !i.cleanVolumes || i.docker == nil {
+		return nil, nil
+	}
+
+	var names []string
+	for _, mount := range i.runOptions().Mounts {
+		source := strings.SplitN(mount, ":", 2)[0]
+		// bind mounts name a host path, which belongs to the host
+		if strings.ContainsAny(source, `/\`) || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+			continue
+		}
+
+		_, err := i.docker.InspectVolume(source)
+		if errors.Is(err, docker.ErrNoSuchVolume) {
+			names = append(names, source)
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect volume %s: %w", source, err)
+		}
+	}
+
+	return names, nil
+}
+
+// CloseWithTimeout is like Close, but gives up waiting for docker after d so an unresponsive daemon can't hang test
+// teardown forever. The purge keeps running in the background after a timeout.
+func (i *Instance) CloseWithTimeout(d time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- i.Close()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		return fmt.Errorf("timed out after %s closing localstack instance", d)
+	}
+}
+
+// CloseOnPanic closes the Instance if the surrounding function panics, then re-panics so the failure still
+// surfaces. It must be deferred directly, e.g. defer instance.CloseOnPanic().
+func (i *Instance) CloseOnPanic() {
+	if r := recover(); r != nil {
+		if err := i.Close(); err != nil {
+			i.logger.Logf("failed to close localstack instance after panic: %s", err)
+		}
+
+		panic(r)
+	}
+}
+
+func withDefaults(i *Instance) {
+	if i.host == "" {
+		i.host = "http://localhost"
+	}
+
+	if i.ssl {
+		if u, err := url.Parse(i.host); err == nil {
+			u.Scheme = "https"
+			i.host = u.String()
+		}
+	}
+
+	if i.region == "" {
+		i.region = "us-east-1"
+	}
+
+	if i.key == "" {
+		i.key = "key"
+	}
+
+	if i.secret == "" {
+		i.secret = "secret"
+	}
+
+	if i.session == "" {
+		i.session = "session"
+	}
+
+	if i.portMode == 0 {
+		i.portMode = portModeForTag(i.tag)
+		i.detectPorts = true
+	}
+
+	if i.arch == "" {
+		i.arch = runtime.GOARCH
+	}
+
+	// latest is published for arm64, but docker can still end up with the amd64 image, e.g. when the daemon's default
+	// platform is set, so pin it rather than running under emulation. Mirrors often only carry amd64, so they're left
+	// to docker.
+	if repo := i.repository(); i.platform == "" && i.tag == "" && (repo == image || repo == proImage) {
+		i.platform = nativePlatforms[i.arch]
+	}
+
+	if i.logger == nil {
+		i.logger = stdLogger{}
+	}
+
+	if i.healthCheck == nil {
+		i.healthCheck = defaultReady
+	}
+
+	if i.probes == nil {
+		i.probes = serviceProbes
+	}
+
+	if i.now == nil {
+		i.now = time.Now
+	}
+
+	if i.sleep == nil {
+		i.sleep = time.Sleep
+	}
+}
+
+// defaultReady is the default health check. Images with an edge port report readiness through their health
+// endpoint; older images are considered ready once S3 responds.
+func defaultReady(ctx context.Context, i *Instance) error {
+	if i.portMode == PortModeLegacy {
+		return s3Ready(ctx, i)
+	}
+
+	return healthReady(ctx, i)
+}
+
+// s3Ready considers localstack ready once S3 responds to a ListBuckets call.
+func s3Ready(ctx context.Context, i *Instance) error {
+	_, err := i.S3Client().ListBucketsRequest(&s3.ListBucketsInput{}).Send(ctx)
+	return err
+}
+
+// serviceProbes maps services to a cheap call used to check whether they're ready.
+var serviceProbes = map[string]func(ctx context.Context, i *Instance) error{
+	"s3": s3Ready,
+	"sqs": func(ctx context.Context, i *Instance) error {
+		_, err := sqs.New(i.Config()).ListQueuesRequest(&sqs.ListQueuesInput{}).Send(ctx)
+		return err
+	},
+	"sns": func(ctx context.Context, i *Instance) error {
+		_, err := sns.New(i.Config()).ListTopicsRequest(&sns.ListTopicsInput{}).Send(ctx)
+		return err
+	},
+	"dynamodb": func(ctx context.Context, i *Instance) error {
+		_, err := dynamodb.New(i.Config()).ListTablesRequest(&dynamodb.ListTablesInput{}).Send(ctx)
+		return err
+	},
+	"kinesis": func(ctx context.Context, i *Instance) error {
+		_, err := kinesis.New(i.Config()).ListStreamsRequest(&kinesis.ListStreamsInput{}).Send(ctx)
+		return err
+	},
+	"lambda": func(ctx context.Context, i *Instance) error {
+		_, err := lambda.New(i.Config()).ListFunctionsRequest(&lambda.ListFunctionsInput{}).Send(ctx)
+		return err
+	},
+	"secretsmanager": func(ctx context.Context, i *Instance) error {
+		_, err := secretsmanager.New(i.Config()).ListSecretsRequest(&secretsmanager.ListSecretsInput{}).Send(ctx)
+		return err
+	},
+	"sts": func(ctx context.Context, i *Instance) error {
+		_, err := sts.New(i.Config()).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{}).Send(ctx)
+		return err
+	},
+}
+
+// backoff produces exponentially growing delays up to max. Each delay gets up to 10% of jitter added so that
+// instances started in parallel don't probe in lockstep.
+type backoff struct {
+	delay time.Duration
+	max   time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.delay
+	jitter := time.Duration(rand.Int63n(int64(delay)/10 + 1)) //nolint:gosec // jitter doesn't need a secure source
+
+	b.delay *= 2
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+
+	return delay + jitter
+}
+
+// dockerHost returns the host serving ports published by the docker daemon at endpoint, or an empty string when the
+// daemon is local.
+func dockerHost(endpoint string) string {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+
+	switch parsed.Scheme {
+	case "tcp", "http", "https", "ssh":
+	default:
+		return ""
+	}
+
+	hostname := parsed.Hostname()
+	if hostname == "" {
+		return ""
+	}
+
+	if strings.Contains(hostname, ":") {
+		hostname = "[" + hostname + "]"
+	}
+
+	return "http://" + hostname
+}
+
+// checkExternal rejects options that only make sense for a container New starts, rather than letting NewExternal
+// ignore them.
+func (i *Instance) checkExternal() error {
+	switch {
+	case len(i.fixed) > 0:
+		return errors.New("WithFixedPort can't be used with NewExternal, include the port in the host instead")
+	case i.portMode == PortModeLegacy:
+		return errors.New("NewExternal only supports PortModeEdge")
+	}
+
+	containerOnly := []struct {
+		set    bool
+		option string
+	}{
+		{i.hostNet, "WithHostNetwork"},
+		{i.network != "", "WithNetwork"},
+		{len(i.env) > 0, "WithEnv, or an option that sets the container environment,"},
+		{i.image != "", "WithImage"},
+		{i.tag != "", "WithImageTag"},
+		{i.platform != "", "WithPlatform"},
+		{i.amd64Fallback, "WithPlatformFallback"},
+		{i.auth != (docker.AuthConfiguration{}), "WithRegistryAuth"},
+		{i.name != "", "WithName"},
+		{len(i.mounts) > 0, "WithDataDir, WithInitScripts, or another option that mounts into the container,"},
+		{len(i.labels) > 0, "WithLabels"},
+		{len(i.hosts) > 0, "WithExtraHosts"},
+		{i.memory > 0, "WithMemory"},
+		{i.cpu > 0, "WithCPUShares"},
+		{len(i.cmd) > 0, "WithCmd"},
+		{i.cleanVolumes, "WithCleanVolumes"},
+		{i.stopTimeout > 0, "WithStopTimeout"},
+		{i.initTimeout > 0, "WithInitTimeout"},
+		{len(i.tweaks) > 0, "WithRunOptions"},
+		{len(i.preStart) > 0, "WithPreStart"},
+		{i.readyLog != "", "WithReadyLog"},
+	}
+
+	for _, opt := range containerOnly {
+		if opt.set {
+			return fmt.Errorf("%s only applies to containers started by New and can't be used with NewExternal", opt.option)
+		}
+	}
+
+	return nil
+}
+
+// splitHostPort splits the port off an external localstack host, defaulting to the edge port.
+func splitHostPort(host string) (string, string, error) {
+	normalized := strings.TrimRight(strings.TrimSpace(host), "/")
+	if !strings.Contains(normalized, "://") {
+		normalized = "http://" + normalized
+	}
+
+	parsed, err := url.Parse(normalized)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid host %q: %s", host, err)
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		port = strings.TrimSuffix(edgePort, "/tcp")
+	}
+
+	parsed.Host = parsed.Hostname()
+	if strings.Contains(parsed.Host, ":") {
+		parsed.Host = "[" + parsed.Host + "]"
+	}
+
+	endpoint, err := normalizeHost(parsed.String())
+	if err != nil {
+		return "", "", err
+	}
+
+	return endpoint, port, nil
+}
+
+func normalizeHost(host string) (string, error) {
+	normalized := strings.TrimRight(strings.TrimSpace(host), "/")
+	if !strings.Contains(normalized, "://") {
+		normalized = "http://" + normalized
+	}
+
+	parsed, err := url.Parse(normalized)
+	if err != nil {
+		return "", fmt.Errorf("invalid host %q: %s", host, err)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("invalid host %q: scheme must be http or https", host)
+	}
+
+	if parsed.Hostname() == "" {
+		return "", fmt.Errorf("invalid host %q: missing hostname", host)
+	}
+
+	if parsed.Port() != "" || parsed.Path != "" || parsed.RawQuery != "" {
+		return "", fmt.Errorf("invalid host %q: host must not include a port, path, or query", host)
+	}
+
+	return normalized, nil
+}
+
+// hasEnv reports whether the container env sets key.
+func (i *Instance) hasEnv(key string) bool {
+	for _, env := range i.env {
+		if strings.HasPrefix(env, key+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setEnv sets an environment variable for the container, replacing any previous value for the same key.
+func (i *Instance) setEnv(key, value string) {
+	prefix := key + "="
+	for idx, env := range i.env {
+		if strings.HasPrefix(env, prefix) {
+			i.env[idx] = prefix + value
+			return
+		}
+	}
+
+	i.env = append(i.env, prefix+value)
+}
+
+// runEnv returns the container's environment, which is derived from the services and SSL setting as well as the
+// variables set by options.
+func (i *Instance) runEnv() []string {
+	env := append([]string{i.serviceString()}, i.env...)
+	if i.ssl && !i.hasEnv("USE_SSL") {
+		env = append(env, "USE_SSL=1")
+	}
+
+	return env
+}
+
+// runOptions assembles the options used to start the localstack container.
+func (i *Instance) runOptions() *dockertest.RunOptions {
+	var entrypoint, cmd []string
+	if len(i.cmd) > 0 {
+		entrypoint, cmd = i.cmd[:1], i.cmd[1:]
+	}
+
+	var bindings map[docker.Port][]docker.PortBinding
+	for containerPort, hostPort := range i.fixed {
+		if bindings == nil {
+			bindings = make(map[docker.Port][]docker.PortBinding, len(i.fixed))
+		}
+
+		bindings[docker.Port(containerPort)] = []docker.PortBinding{{HostPort: hostPort}}
+	}
+
+	var exposed []string
+	if i.gateway != 0 {
+		// the image only exposes the default ports, so a custom gateway port has to be published explicitly
+		exposed = append(exposed, i.edgePort())
+	}
+
+	for _, port := range i.custom {
+		exposed = append(exposed, port)
+	}
+	sort.Strings(exposed)
+
+	opts := &dockertest.RunOptions{
+		Name:         i.name,
+		Repository:   i.repository(),
+		Tag:          i.tag,
+		Platform:     i.platform,
+		PortBindings: bindings,
+		Env:          i.runEnv(),
+		Mounts:       i.mounts,
+		Labels:       i.labels,
+		Auth:         i.auth,
+		ExtraHosts:   i.hosts,
+		Entrypoint:   entrypoint,
+		Cmd:          cmd,
+		ExposedPorts: exposed,
+	}
+
+	for _, tweak := range i.tweaks {
+		tweak(opts)
+	}
+
+	return opts
+}
+
+// repository returns the image repository the container is run from.
+func (i *Instance) repository() string {
+	if i.image == "" {
+		return image
+	}
+
+	return i.image
+}
+
+// hostConfig applies settings RunOptions doesn't cover to the container's host config.
+func (i *Instance) hostConfig(config *docker.HostConfig) {
+	if i.memory > 0 {
+		config.Memory = i.memory
+	}
+
+	if i.cpu > 0 {
+		config.CPUShares = i.cpu
+	}
+
+	if i.hostNet {
+		config.NetworkMode = "host"
+		// ports can't be published on the host network
+		config.PublishAllPorts = false
+	}
+}
+
+func (i *Instance) serviceString() string {
+	i.normalizeServices()
 	return fmt.Sprintf("SERVICES=%s", makeCsv(i.services))
 }
 
+// normalizeServices lowercases and deduplicates the configured services, adding any that are always required.
+func (i *Instance) normalizeServices() {
+	services := make([]string, 0, len(i.services)+1)
+	seen := make(map[string]bool)
+	for _, service := range i.services {
+		service = strings.ToLower(strings.TrimSpace(service))
+		if service == "" || seen[service] {
+			continue
+		}
+
+		seen[service] = true
+		services = append(services, service)
+	}
+
+	// s3 has to be available in order for the default Wait() to work, unless the caller opted out.
+	if !seen["s3"] && !i.skipS3 {
+		services = append(services, "s3")
+	}
+
+	i.services = services
+}
+
+// validate checks that the Instance is configured to run something. Without any services every call would fall
+// through the resolver to real AWS.
+func (i *Instance) validate() error {
+	if len(i.services) == 0 {
+		return ErrNoServices
+	}
+
+	for _, service := range i.services {
+		if _, ok := i.containerPort(service); ok {
+			continue
+		}
+
+		if i.servicesEnv != "" {
+			return fmt.Errorf("invalid %s: unknown service %q", i.servicesEnv, service)
+		}
+
+		return fmt.Errorf("unknown service %q", service)
+	}
+
+	if i.snapshot && !i.hasEnv("LOCALSTACK_AUTH_TOKEN") {
+		return errors.New("loading snapshots requires localstack pro, see WithProToken")
+	}
+
+	if len(i.aliases) > 0 && i.network == "" {
+		return errors.New("network aliases require WithNetwork")
+	}
+
+	if i.readiness == "" {
+		return nil
+	}
+
+	for _, service := range i.services {
+		if service == i.readiness {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("readiness service %q is not enabled", i.readiness)
+}
+
 // Config gives an AWS client configuration for talking to localstack.
 func (i *Instance) Config() aws.Config {
-	return aws.Config{
-		Credentials: aws.NewStaticCredentialsProvider(i.key, i.secret, i.session),
-		Region:      i.region,
+	return i.ConfigContext(context.Background())
+}
+
+// ConfigContext is like Config, but makes the values stored in ctx visible to every request sent by clients built
+// from the config. Values on the context a request is sent with take precedence. Cancellation and deadlines still
+// come from the request's own context.
+func (i *Instance) ConfigContext(ctx context.Context) aws.Config {
+	cfg := i.ConfigWithBase(aws.Config{
+		Region: i.region,
 		// DisableRestProtocolURICleaning: true,
-		DisableEndpointHostPrefix: true,
-		HTTPClient:                defaults.HTTPClient(),
-		Handlers:                  defaults.Handlers(),
-		Logger:                    defaults.Logger(),
-		EndpointResolver:          aws.EndpointResolverFunc(i.resolver),
+		HTTPClient: i.client(),
+		Handlers:   defaults.Handlers(),
+		Logger:     defaults.Logger(),
+	})
+
+	if ctx != context.Background() {
+		cfg.Handlers.Validate.PushFrontNamed(aws.NamedHandler{
+			Name: "localstack.ContextValues",
+			Fn: func(r *aws.Request) {
+				r.SetContext(valuesContext{Context: r.Context(), values: ctx})
+			},
+		})
 	}
+
+	return cfg
 }
 
-func makeCsv(strings []string) string {
-	buffer := bytes.NewBufferString("")
-	for idx, str := range strings {
-		_, _ = buffer.WriteString(str)
-		if idx != len(strings) {
-			_, _ = buffer.WriteString(",")
-		}
+// valuesContext layers the values of another context underneath a request's context.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	if value := c.Context.Value(key); value != nil {
+		return value
+	}
+
+	return c.values.Value(key)
+}
+
+// client returns the HTTP client used to talk to localstack.
+func (i *Instance) client() aws.HTTPClient {
+	if i.httpClient != nil {
+		return i.httpClient
+	}
+
+	if i.ssl {
+		return aws.NewBuildableHTTPClient().WithTransportOptions(func(transport *http.Transport) {
+			// localstack's certificate is self-signed
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec // only used against localstack
+		})
+	}
+
+	return defaults.HTTPClient()
+}
+
+// ConfigWithBase layers the localstack credentials and endpoint resolver on top of a user supplied config, e.g. one
+// loaded from the environment, leaving everything else intact. The Instance region is used if base has none, and the
+// base retryer is only replaced when WithRetries was given.
+func (i *Instance) ConfigWithBase(base aws.Config) aws.Config {
+	cfg := base.Copy()
+	cfg.Credentials = aws.NewStaticCredentialsProvider(i.key, i.secret, i.session)
+	cfg.EndpointResolver = i.EndpointResolver()
+	cfg.DisableEndpointHostPrefix = true
+
+	if cfg.Region == "" {
+		cfg.Region = i.region
+	}
+
+	if i.retries > 0 {
+		cfg.Retryer = aws.DefaultRetryer{NumMaxRetries: i.retries - 1}
 	}
 
-	return buffer.String()
+	return cfg
+}
+
+// EndpointResolver returns the resolver pointing AWS clients at localstack, for callers assembling their own config.
+func (i *Instance) EndpointResolver() aws.EndpointResolver {
+	return aws.EndpointResolverFunc(i.resolver)
+}
+
+func makeCsv(values []string) string {
+	return strings.Join(values, ",")
 }
 
 func (i *Instance) makeResolver() serviceResolver {
 	defaultResolver := endpoints.NewDefaultResolver()
 	return func(service, region string) (aws.Endpoint, error) {
-		switch service {
-		case "apigateway":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4567/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "kinesis":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4568/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "dynamodb":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4569/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "streams.dynamodb":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4570/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "elasticsearch":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4571/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "s3":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4572/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "firehose":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4573/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "lambda":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4574/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "sns":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4575/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "sqs":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4576/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "redshift":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4577/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "es":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4578/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "ses":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4579/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "route53":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4580/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "cloudformation":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4581/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "cloudwatch":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4582/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "ssm":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4583/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "secretsmanager":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4584/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		// case "stepfunctions":
-		// 	return aws.Endpoint{
-		// 		URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4585/tcp")),
-		// 		SigningRegion: "test-siging-region",
-		// 	}, nil
-		case "logs":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4586/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "events":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4587/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "sts":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4592/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "iam":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4593/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		case "ec2":
-			return aws.Endpoint{
-				URL:           fmt.Sprintf("%s:%s", i.host, i.resource.GetPort("4597/tcp")),
-				SigningRegion: "test-siging-region",
-			}, nil
-		default:
+		if name, ok := sdkServices[service]; ok {
+			service = name
+		}
+
+		port, ok := i.containerPort(service)
+		if !ok {
+			if i.strict {
+				return aws.Endpoint{}, fmt.Errorf("service %q is not supported by localstack", service)
+			}
+
 			return defaultResolver.ResolveEndpoint(service, region)
 		}
+
+		if i.publishedPort(port) == "" {
+			return aws.Endpoint{}, fmt.Errorf("no host port is published for localstack service %q on container port %s", service, port)
+		}
+
+		endpoint := i.url(port)
+		if service == "s3" && i.s3Domain != "" {
+			endpoint = i.virtualHostURL(port)
+		}
+
+		return aws.Endpoint{
+			URL:           endpoint,
+			SigningRegion: i.signingRegion(region),
+		}, nil
+	}
+}
+
+// virtualHostURL is like url, but uses the S3 virtual host domain in place of the host so bucket subdomains resolve.
+func (i *Instance) virtualHostURL(port string) string {
+	scheme := "http"
+	if u, err := url.Parse(i.host); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+
+	return fmt.Sprintf("%s://%s:%s%s", scheme, i.s3Domain, i.publishedPort(port), i.prefix)
+}
+
+// edgePort returns the container port the edge gateway listens on.
+func (i *Instance) edgePort() string {
+	if i.gateway != 0 {
+		return fmt.Sprintf("%d/tcp", i.gateway)
+	}
+
+	return edgePort
+}
+
+// url returns the host URL serving the given container port.
+func (i *Instance) url(port string) string {
+	return fmt.Sprintf("%s:%s%s", i.host, i.publishedPort(port), i.prefix)
+}
+
+// publishedPort returns the host port serving the given container port. On the host network container ports are
+// used as-is.
+func (i *Instance) publishedPort(port string) string {
+	if i.hostNet {
+		return strings.TrimSuffix(port, "/tcp")
+	}
+
+	return i.hostPort(port)
+}
+
+// setResource points the Instance at a new container, dropping any ports cached for the previous one.
+func (i *Instance) setResource(resource *dockertest.Resource) {
+	i.portsMu.Lock()
+	defer i.portsMu.Unlock()
+
+	i.resource = resource
+	i.ports = nil
+}
+
+// hostPort returns the host port published for a container port, looking it up only once per resource.
+func (i *Instance) hostPort(port string) string {
+	i.portsMu.Lock()
+	defer i.portsMu.Unlock()
+
+	if hostPort, ok := i.ports[port]; ok {
+		return hostPort
+	}
+
+	if hostPort, ok := i.fixed[port]; ok {
+		return hostPort
+	}
+
+	// external instances only publish the edge port they were given
+	if i.resource == nil {
+		return ""
+	}
+
+	if i.ports == nil {
+		i.ports = make(map[string]string)
+	}
+
+	hostPort := i.resource.GetPort(port)
+	i.ports[port] = hostPort
+	return hostPort
+}
+
+// signingRegion returns the region an endpoint resolved for region is signed for. Clients in different regions sign
+// for their own region unless WithSigningRegion overrides it.
+func (i *Instance) signingRegion(region string) string {
+	if i.signing != "" {
+		return i.signing
+	}
+
+	if region != "" {
+		return region
+	}
+
+	return i.region
+}
+
+// detectPortMode settles a guessed PortMode by looking at what the container publishes: the edge port if it's
+// mapped, otherwise the legacy ports of the enabled services. It only runs once, so the resolver sticks with the
+// decision. Containers on the host network publish nothing and keep the guess.
+func (i *Instance) detectPortMode() {
+	if !i.detectPorts || i.hostNet {
+		return
+	}
+	i.detectPorts = false
+
+	if i.hostPort(i.edgePort()) != "" {
+		i.portMode = PortModeEdge
+		return
+	}
+
+	for _, service := range i.services {
+		if port, ok := legacyPorts[service]; ok && i.hostPort(port) != "" {
+			if i.portMode != PortModeLegacy {
+				i.logger.Logf("localstack edge port %s isn't published, falling back to legacy ports", i.edgePort())
+			}
+
+			i.portMode = PortModeLegacy
+			return
+		}
+	}
+}
+
+// containerPort returns the container port serving the given service under the Instance's PortMode.
+func (i *Instance) containerPort(service string) (string, bool) {
+	if port, ok := i.custom[service]; ok {
+		return port, true
+	}
+
+	port, ok := legacyPorts[service]
+	if !ok {
+		return "", false
+	}
+
+	if i.portMode == PortModeEdge {
+		return i.edgePort(), true
+	}
+
+	return port, true
+}
+
+// portModeForTag guesses the PortMode supported by an image tag. Only explicit versions older than 0.11 predate the
+// edge port, so anything else (latest, stable, unparsable tags) is assumed to be edge.
+func portModeForTag(tag string) PortMode {
+	parts := strings.SplitN(strings.TrimPrefix(tag, "v"), ".", 3)
+	if len(parts) < 2 {
+		return PortModeEdge
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return PortModeEdge
+	}
+
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return PortModeEdge
+	}
+
+	if major == 0 && minor < 11 {
+		return PortModeLegacy
 	}
+
+	return PortModeEdge
 }
@@ -0,0 +1,4236 @@
+package localstack
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// fakePool records the containers it's asked to run instead of talking to docker.
+type fakePool struct {
+	runs        []*dockertest.RunOptions
+	hostConfigs []docker.HostConfig
+	runErrs     []error
+	purged      []*dockertest.Resource
+	purgeErr    error
+	// purges block until blockPurge is closed, when set
+	blockPurge chan struct{}
+	// runs block until blockRun is closed, when set
+	blockRun chan struct{}
+	// published limits the container ports containers publish, which defaults to 4566-4597
+	published []string
+	// leaks records a container with client for each failed run, as dockertest does when starting one fails
+	leaks *fakeClient
+}
+
+func (p *fakePool) RunWithOptions(opts *dockertest.RunOptions, hcOpts ...func(*docker.HostConfig)) (*dockertest.Resource, error) {
+	if p.blockRun != nil {
+		<-p.blockRun
+	}
+
+	p.runs = append(p.runs, opts)
+
+	var hostConfig docker.HostConfig
+	for _, opt := range hcOpts {
+		opt(&hostConfig)
+	}
+	p.hostConfigs = append(p.hostConfigs, hostConfig)
+
+	if len(p.runErrs) > 0 {
+		err := p.runErrs[0]
+		p.runErrs = p.runErrs[1:]
+		if p.leaks != nil {
+			p.leaks.containers = append(p.leaks.containers, docker.APIContainers{
+				ID:     fmt.Sprintf("created-%d", len(p.runs)),
+				Labels: opts.Labels,
+			})
+		}
+
+		return nil, err
+	}
+
+	resource := fakeResource(fmt.Sprintf("fake-%d", len(p.runs)))
+	if p.published != nil {
+		ports := resource.Container.NetworkSettings.Ports
+		for port := range ports {
+			if !contains(p.published, string(port)) {
+				delete(ports, port)
+			}
+		}
+	}
+
+	return resource, nil
+}
+
+func (p *fakePool) Purge(r *dockertest.Resource) error {
+	if p.blockPurge != nil {
+		<-p.blockPurge
+	}
+
+	p.purged = append(p.purged, r)
+	return p.purgeErr
+}
+
+// fakeClient records the calls made straight to the docker client.
+type fakeClient struct {
+	// volumes holds the names of the volumes that already exist
+	volumes        []string
+	removedVolumes []string
+	removeErr      error
+	// images holds the images docker has by reference, pulls the images PullImage was asked for
+	images  map[string]*docker.Image
+	pulls   []docker.PullImageOptions
+	pullErr error
+	// containers holds the containers ListContainers finds, removedContainers the ids RemoveContainer was given
+	containers        []docker.APIContainers
+	removedContainers []string
+	// killed holds the signal sent to each container, ignoresSignals keeps containers running regardless
+	killed         map[string]docker.Signal
+	killErr        error
+	waited         []string
+	ignoresSignals bool
+	// networks holds the existing networks by name
+	networks        map[string]*docker.Network
+	createdNetworks []string
+	removedNetworks []string
+	pingErr         error
+	// connections holds the endpoint config containers were connected with, by network id
+	connections map[string]*docker.EndpointConfig
+	// exited holds the exit code of containers that stopped, others are running
+	exited map[string]int
+	logs   string
+	// execs holds the commands run in containers, execExit the exit code they all report
+	execs    [][]string
+	execOut  string
+	execExit int
+	// uploads holds the files copied into containers by their full path in the container
+	uploads map[string]string
+}
+
+func (c *fakeClient) InspectContainer(id string) (*docker.Container, error) {
+	code, ok := c.exited[id]
+	return &docker.Container{ID: id, State: docker.State{Running: !ok, ExitCode: code}}, nil
+}
+
+func (c *fakeClient) Logs(opts docker.LogsOptions) error {
+	if _, err := io.WriteString(opts.OutputStream, c.logs); err != nil {
+		return err
+	}
+
+	// a followed log stays open until the caller gives up on it
+	if opts.Follow {
+		<-opts.Context.Done()
+		return opts.Context.Err()
+	}
+
+	return nil
+}
+
+func (c *fakeClient) ConnectNetwork(id string, opts docker.NetworkConnectionOptions) error {
+	if c.connections == nil {
+		c.connections = make(map[string]*docker.EndpointConfig)
+	}
+
+	c.connections[id] = opts.EndpointConfig
+	return nil
+}
+
+func (c *fakeClient) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	c.execs = append(c.execs, opts.Cmd)
+	return &docker.Exec{ID: fmt.Sprintf("exec-%d", len(c.execs))}, nil
+}
+
+func (c *fakeClient) StartExec(id string, opts docker.StartExecOptions) error {
+	_, err := io.WriteString(opts.OutputStream, c.execOut)
+	return err
+}
+
+func (c *fakeClient) InspectExec(id string) (*docker.ExecInspect, error) {
+	return &docker.ExecInspect{ID: id, ExitCode: c.execExit}, nil
+}
+
+func (c *fakeClient) UploadToContainer(id string, opts docker.UploadToContainerOptions) error {
+	if c.uploads == nil {
+		c.uploads = make(map[string]string)
+	}
+
+	tr := tar.NewReader(opts.InputStream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		c.uploads[path.Join(opts.Path, header.Name)] = string(content)
+	}
+}
+
+func (c *fakeClient) Ping() error {
+	return c.pingErr
+}
+
+func (c *fakeClient) RemoveVolumeWithOptions(opts docker.RemoveVolumeOptions) error {
+	c.removedVolumes = append(c.removedVolumes, opts.Name)
+	return c.removeErr
+}
+
+func (c *fakeClient) InspectImage(name string) (*docker.Image, error) {
+	image, ok := c.images[name]
+	if !ok {
+		return nil, docker.ErrNoSuchImage
+	}
+
+	return image, nil
+}
+
+func (c *fakeClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	c.pulls = append(c.pulls, opts)
+	if c.pullErr != nil {
+		return c.pullErr
+	}
+
+	if c.images == nil {
+		c.images = make(map[string]*docker.Image)
+	}
+
+	image := &docker.Image{ID: opts.Repository + ":" + opts.Tag}
+	if parts := strings.Split(opts.Platform, "/"); len(parts) > 1 {
+		image.OS, image.Architecture = parts[0], parts[1]
+	}
+
+	c.images[opts.Repository+":"+opts.Tag] = image
+	return nil
+}
+
+func (c *fakeClient) InspectVolume(name string) (*docker.Volume, error) {
+	if !contains(c.volumes, name) {
+		return nil, docker.ErrNoSuchVolume
+	}
+
+	return &docker.Volume{Name: name}, nil
+}
+
+func (c *fakeClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	var found []docker.APIContainers
+	for _, container := range c.containers {
+		matches := true
+		for _, filter := range opts.Filters["label"] {
+			key, value, _ := strings.Cut(filter, "=")
+			if container.Labels[key] != value {
+				matches = false
+			}
+		}
+
+		if matches {
+			found = append(found, container)
+		}
+	}
+
+	return found, nil
+}
+
+func (c *fakeClient) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	c.removedContainers = append(c.removedContainers, opts.ID)
+	return nil
+}
+
+func (c *fakeClient) KillContainer(opts docker.KillContainerOptions) error {
+	if c.killed == nil {
+		c.killed = make(map[string]docker.Signal)
+	}
+
+	c.killed[opts.ID] = opts.Signal
+	return c.killErr
+}
+
+func (c *fakeClient) WaitContainerWithContext(id string, ctx context.Context) (int, error) {
+	c.waited = append(c.waited, id)
+	if c.ignoresSignals {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	return 0, nil
+}
+
+func (c *fakeClient) NetworkInfo(id string) (*docker.Network, error) {
+	if network, ok := c.networks[id]; ok {
+		return network, nil
+	}
+
+	return nil, &docker.NoSuchNetwork{ID: id}
+}
+
+func (c *fakeClient) CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error) {
+	c.createdNetworks = append(c.createdNetworks, opts.Name)
+	return &docker.Network{ID: "net-" + opts.Name, Name: opts.Name}, nil
+}
+
+func (c *fakeClient) RemoveNetwork(id string) error {
+	c.removedNetworks = append(c.removedNetworks, id)
+	return nil
+}
+
+// fakeResource builds a container that publishes the edge port and every legacy port on the host port 1<port>.
+func fakeResource(id string) *dockertest.Resource {
+	ports := map[docker.Port][]docker.PortBinding{}
+	for port := 4566; port <= 4597; port++ {
+		ports[docker.Port(fmt.Sprintf("%d/tcp", port))] = []docker.PortBinding{{HostIP: "0.0.0.0", HostPort: fmt.Sprintf("1%d", port)}}
+	}
+
+	return &dockertest.Resource{
+		Container: &docker.Container{
+			ID:              id,
+			NetworkSettings: &docker.NetworkSettings{Ports: ports},
+		},
+	}
+}
+
+// fakeLogger collects logged messages.
+type fakeLogger struct {
+	messages []string
+}
+
+func (l *fakeLogger) Logf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func withPool(pool dockerPool) InstanceOpt {
+	return func(i *Instance) error {
+		i.pool = pool
+		return nil
+	}
+}
+
+func withClient(client dockerClient) InstanceOpt {
+	return func(i *Instance) error {
+		i.docker = client
+		return nil
+	}
+}
+
+func noSleep(i *Instance) error {
+	i.sleep = func(d time.Duration) {}
+	return nil
+}
+
+func Test_WaitBackoff(t *testing.T) {
+	// SETUP
+	failures := 4
+	attempts := 0
+	delays := []time.Duration{}
+
+	instance := &Instance{
+		healthCheck: func(ctx context.Context, i *Instance) error {
+			attempts++
+			if attempts <= failures {
+				return errors.New("not ready")
+			}
+
+			return nil
+		},
+		sleep: func(d time.Duration) {
+			delays = append(delays, d)
+		},
+	}
+	withDefaults(instance)
+
+	// RUN
+	if err := instance.Wait(time.Minute); err != nil {
+		t.Fatalf("unexpected error waiting: %s", err)
+	}
+
+	// ASSERT
+	if attempts != failures+1 {
+		t.Fatalf("expected %d probe attempts, got %d", failures+1, attempts)
+	}
+
+	if len(delays) != failures {
+		t.Fatalf("expected %d delays, got %d", failures, len(delays))
+	}
+
+	if delays[0] < initialProbeDelay {
+		t.Fatalf("first delay should be at least %s, got %s", initialProbeDelay, delays[0])
+	}
+
+	for idx := 1; idx < len(delays); idx++ {
+		if delays[idx] <= delays[idx-1] {
+			t.Fatalf("delays should grow between attempts, got %v", delays)
+		}
+	}
+}
+
+func Test_WaitBackoffCapped(t *testing.T) {
+	// SETUP
+	delays := backoff{delay: initialProbeDelay, max: maxProbeDelay}
+
+	// RUN
+	for idx := 0; idx < 10; idx++ {
+		delays.next()
+	}
+
+	// ASSERT
+	if delay := delays.next(); delay < maxProbeDelay || delay > maxProbeDelay+maxProbeDelay/10 {
+		t.Fatalf("delay should be capped at %s plus jitter, got %s", maxProbeDelay, delay)
+	}
+}
+
+func Test_WaitTimeout(t *testing.T) {
+	// SETUP
+	start := time.Now()
+	now := start
+	probeErr := errors.New("connection refused")
+	instance := &Instance{
+		healthCheck: func(ctx context.Context, i *Instance) error {
+			return probeErr
+		},
+		now: func() time.Time {
+			return now
+		},
+		sleep: func(d time.Duration) {
+			now = now.Add(d)
+		},
+	}
+	withDefaults(instance)
+
+	// RUN
+	err := instance.Wait(5 * time.Second)
+
+	// ASSERT
+	if err == nil {
+		t.Fatal("wait should have timed out")
+	}
+
+	if elapsed := now.Sub(start); elapsed > 5*time.Second {
+		t.Fatalf("wait should not sleep past its deadline, slept for %s", elapsed)
+	}
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected a *TimeoutError, got %T", err)
+	}
+
+	if timeoutErr.Err != probeErr || !errors.Is(err, probeErr) {
+		t.Fatalf("the last probe error should be attached, got %v", timeoutErr.Err)
+	}
+
+	if timeoutErr.Elapsed != 5*time.Second {
+		t.Fatalf("expected the elapsed time to be recorded, got %s", timeoutErr.Elapsed)
+	}
+}
+
+func Test_ServiceString(t *testing.T) {
+	cases := []struct {
+		name     string
+		services []string
+		expected string
+	}{
+		{"default", nil, "SERVICES=s3"},
+		{"uppercase", []string{"SQS", "DynamoDB"}, "SERVICES=sqs,dynamodb,s3"},
+		{"uppercase s3", []string{"S3"}, "SERVICES=s3"},
+		{"duplicates", []string{"sqs", "sqs", "SQS"}, "SERVICES=sqs,s3"},
+		{"contains s3", []string{"s3", "sqs"}, "SERVICES=s3,sqs"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// SETUP
+			instance := &Instance{services: c.services}
+
+			// RUN
+			result := instance.serviceString()
+
+			// ASSERT
+			if result != c.expected {
+				t.Fatalf("expected %q, got %q", c.expected, result)
+			}
+		})
+	}
+}
+
+func Test_WithHealthCheck(t *testing.T) {
+	// SETUP
+	invocations := 0
+	check := func(ctx context.Context, i *Instance) error {
+		invocations++
+		if invocations < 3 {
+			return errors.New("not ready")
+		}
+
+		return nil
+	}
+
+	instance := &Instance{
+		sleep: func(d time.Duration) {},
+	}
+
+	if err := WithHealthCheck(check)(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+
+	// RUN
+	if err := instance.Wait(time.Minute); err != nil {
+		t.Fatalf("unexpected error waiting: %s", err)
+	}
+
+	// ASSERT
+	if invocations != 3 {
+		t.Fatalf("expected the custom health check to be invoked 3 times, got %d", invocations)
+	}
+
+	if !instance.Ready(context.TODO()) {
+		t.Fatalf("instance should report ready once the custom health check passes")
+	}
+}
+
+func Test_WithDataDir(t *testing.T) {
+	// SETUP
+	instance := &Instance{}
+	opts := []InstanceOpt{WithDataDir("/tmp/seed"), WithPersistence(true)}
+	for _, opt := range opts {
+		if err := opt(instance); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// RUN
+	runOpts := instance.runOptions()
+
+	// ASSERT
+	if !contains(runOpts.Env, "DATA_DIR="+containerDataDir) {
+		t.Fatalf("expected DATA_DIR in run env, got %v", runOpts.Env)
+	}
+
+	if !contains(runOpts.Env, "PERSISTENCE=1") {
+		t.Fatalf("expected PERSISTENCE in run env, got %v", runOpts.Env)
+	}
+
+	if !contains(runOpts.Mounts, "/tmp/seed:"+containerDataDir) {
+		t.Fatalf("expected data dir mount, got %v", runOpts.Mounts)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func Test_WithHost(t *testing.T) {
+	cases := []struct {
+		name     string
+		host     string
+		expected string
+		fails    bool
+	}{
+		{"valid host", "http://localhost", "http://localhost", false},
+		{"valid https host", "https://docker.internal", "https://docker.internal", false},
+		{"bare hostname", "localhost", "http://localhost", false},
+		{"trailing slash", "http://localhost/", "http://localhost", false},
+		{"unsupported scheme", "tcp://localhost", "", true},
+		{"includes port", "http://localhost:4566", "", true},
+		{"includes path", "http://localhost/localstack", "", true},
+		{"empty host", "", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// SETUP
+			instance := &Instance{}
+
+			// RUN
+			err := WithHost(c.host)(instance)
+
+			// ASSERT
+			if c.fails {
+				if err == nil {
+					t.Fatalf("expected an error for host %q", c.host)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error for host %q: %s", c.host, err)
+			}
+
+			if instance.host != c.expected {
+				t.Fatalf("expected host %q, got %q", c.expected, instance.host)
+			}
+		})
+	}
+}
+
+func Test_WithProToken(t *testing.T) {
+	// SETUP
+	instance := &Instance{}
+	if err := WithProToken("pro-token")(instance); err != nil {
+		t.Fatal(err)
+	}
+
+	// RUN
+	runOpts := instance.runOptions()
+
+	// ASSERT
+	if runOpts.Repository != proImage {
+		t.Fatalf("expected the pro image %q, got %q", proImage, runOpts.Repository)
+	}
+
+	if !contains(runOpts.Env, "LOCALSTACK_AUTH_TOKEN=pro-token") {
+		t.Fatalf("expected the auth token in run env, got %v", runOpts.Env)
+	}
+
+	if err := WithProToken("")(&Instance{}); err == nil {
+		t.Fatalf("an empty pro token should be rejected")
+	}
+}
+
+func Test_WithStartupTimeout(t *testing.T) {
+	// SETUP
+	probes := 0
+	check := func(ctx context.Context, i *Instance) error {
+		probes++
+		if probes < 2 {
+			return errors.New("not ready")
+		}
+
+		return nil
+	}
+
+	// RUN
+	instance, err := New(withPool(&fakePool{}), noSleep, WithHealthCheck(check), WithStartupTimeout(time.Minute))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if probes != 2 {
+		t.Fatalf("New should have waited for readiness, got %d probes", probes)
+	}
+
+	if !instance.Ready(context.TODO()) {
+		t.Fatalf("instance should be ready when New returns")
+	}
+}
+
+func Test_WithoutStartupTimeout(t *testing.T) {
+	// SETUP
+	probes := 0
+	check := func(ctx context.Context, i *Instance) error {
+		probes++
+		return nil
+	}
+
+	// RUN
+	instance, err := New(withPool(&fakePool{}), WithHealthCheck(check))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	probesBeforeWait := probes
+	waitErr := instance.Wait(time.Minute)
+
+	// ASSERT
+	if probesBeforeWait != 0 {
+		t.Fatalf("New should not wait without a startup timeout, got %d probes", probesBeforeWait)
+	}
+
+	if waitErr != nil {
+		t.Fatalf("unexpected error waiting: %s", waitErr)
+	}
+
+	if probes != 1 {
+		t.Fatalf("expected a single probe from the manual Wait, got %d", probes)
+	}
+}
+
+func Test_WithStartupTimeoutFailure(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	now := time.Now()
+	clock := func(i *Instance) error {
+		i.now = func() time.Time { return now }
+		i.sleep = func(d time.Duration) { now = now.Add(d) }
+		return nil
+	}
+	check := func(ctx context.Context, i *Instance) error {
+		return errors.New("not ready")
+	}
+
+	// RUN
+	_, err := New(withPool(pool), clock, WithHealthCheck(check), WithStartupTimeout(time.Second))
+
+	// ASSERT
+	if err == nil {
+		t.Fatalf("New should fail when localstack never becomes ready")
+	}
+
+	if len(pool.purged) != 1 {
+		t.Fatalf("the container should be purged when startup fails")
+	}
+}
+
+func Test_WithHTTPClient(t *testing.T) {
+	// SETUP
+	client := &http.Client{Timeout: 3 * time.Second}
+	instance := &Instance{}
+	if err := WithHTTPClient(client)(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+
+	// RUN
+	cfg := instance.Config()
+
+	// ASSERT
+	if cfg.HTTPClient != client {
+		t.Fatalf("config should use the supplied http client")
+	}
+}
+
+func Test_NewRetriesPortConflicts(t *testing.T) {
+	// SETUP
+	conflict := errors.New("driver failed programming external connectivity: Bind for 0.0.0.0:32768 failed: port is already allocated")
+	pool := &fakePool{runErrs: []error{conflict}}
+
+	// RUN
+	instance, err := New(withPool(pool))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("New should retry port conflicts, got: %s", err)
+	}
+
+	if instance.resource == nil {
+		t.Fatalf("instance should track the container from the successful run")
+	}
+
+	if len(pool.runs) != 2 {
+		t.Fatalf("expected 2 run attempts, got %d", len(pool.runs))
+	}
+}
+
+func Test_NewRemovesFailedRuns(t *testing.T) {
+	// SETUP
+	conflict := errors.New("driver failed programming external connectivity: Bind for 0.0.0.0:32768 failed: port is already allocated")
+	client := &fakeClient{containers: []docker.APIContainers{{ID: "unrelated", Labels: map[string]string{"project": "foo"}}}}
+	pool := &fakePool{runErrs: []error{conflict, conflict}, leaks: client}
+
+	// RUN
+	_, err := New(withPool(pool), withClient(client), WithName("localstack-test"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("New should retry port conflicts, got: %s", err)
+	}
+
+	if strings.Join(client.removedContainers, ",") != "created-1,created-2" {
+		t.Fatalf("expected the containers from failed runs to be removed, got %v", client.removedContainers)
+	}
+}
+
+func Test_NewFixedPortConflict(t *testing.T) {
+	// SETUP
+	conflict := errors.New("driver failed programming external connectivity: Bind for 0.0.0.0:4566 failed: port is already allocated")
+	client := &fakeClient{}
+	pool := &fakePool{runErrs: []error{conflict}, leaks: client}
+
+	// RUN
+	_, err := New(withPool(pool), withClient(client), WithFixedPort(4566, 4566))
+
+	// ASSERT
+	if err == nil || !strings.Contains(err.Error(), "WithFixedPort") {
+		t.Fatalf("expected the fixed port to be blamed, got %v", err)
+	}
+
+	if len(pool.runs) != 1 {
+		t.Fatalf("a conflict on a fixed port shouldn't be retried, got %d attempts", len(pool.runs))
+	}
+
+	if len(client.removedContainers) != 1 {
+		t.Fatalf("expected the container from the failed run to be removed, got %v", client.removedContainers)
+	}
+}
+
+func Test_NewFailsFastOnOtherErrors(t *testing.T) {
+	// SETUP
+	pool := &fakePool{runErrs: []error{errors.New("no such image")}}
+
+	// RUN
+	_, err := New(withPool(pool))
+
+	// ASSERT
+	if err == nil {
+		t.Fatalf("New should return run errors")
+	}
+
+	if len(pool.runs) != 1 {
+		t.Fatalf("non port conflict errors should not be retried, got %d attempts", len(pool.runs))
+	}
+}
+
+func Test_PortMode(t *testing.T) {
+	cases := []struct {
+		service string
+		legacy  string
+	}{
+		{"s3", "http://localhost:14572"},
+		{"sqs", "http://localhost:14576"},
+		{"dynamodb", "http://localhost:14569"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.service, func(t *testing.T) {
+			// SETUP
+			legacy := &Instance{portMode: PortModeLegacy, resource: fakeResource("legacy")}
+			edge := &Instance{portMode: PortModeEdge, resource: fakeResource("edge")}
+			withDefaults(legacy)
+			withDefaults(edge)
+
+			// RUN
+			legacyEndpoint, legacyErr := legacy.makeResolver()(c.service, "us-east-1")
+			edgeEndpoint, edgeErr := edge.makeResolver()(c.service, "us-east-1")
+
+			// ASSERT
+			if legacyErr != nil || edgeErr != nil {
+				t.Fatalf("unexpected resolver errors: %v, %v", legacyErr, edgeErr)
+			}
+
+			if legacyEndpoint.URL != c.legacy {
+				t.Fatalf("expected legacy endpoint %q, got %q", c.legacy, legacyEndpoint.URL)
+			}
+
+			if edgeEndpoint.URL != "http://localhost:14566" {
+				t.Fatalf("expected edge endpoint on the edge port, got %q", edgeEndpoint.URL)
+			}
+		})
+	}
+}
+
+func Test_PortModeDefault(t *testing.T) {
+	cases := []struct {
+		tag      string
+		expected PortMode
+	}{
+		{"", PortModeEdge},
+		{"latest", PortModeEdge},
+		{"0.10.7", PortModeLegacy},
+		{"0.11.0", PortModeEdge},
+		{"v0.9", PortModeLegacy},
+		{"3.0.2", PortModeEdge},
+	}
+
+	for _, c := range cases {
+		t.Run(c.tag, func(t *testing.T) {
+			// SETUP
+			instance := &Instance{tag: c.tag}
+
+			// RUN
+			withDefaults(instance)
+
+			// ASSERT
+			if instance.portMode != c.expected {
+				t.Fatalf("expected port mode %d for tag %q, got %d", c.expected, c.tag, instance.portMode)
+			}
+		})
+	}
+}
+
+func Test_NewWithCleanup(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	instance, cleanup, err := NewWithCleanup(withPool(pool))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	cleanup()
+
+	// ASSERT
+	if len(pool.purged) != 1 || pool.purged[0] != instance.resource {
+		t.Fatalf("cleanup should purge the instance's container")
+	}
+}
+
+func Test_NewWithCleanupLogsErrors(t *testing.T) {
+	// SETUP
+	pool := &fakePool{purgeErr: errors.New("docker went away")}
+	logger := &fakeLogger{}
+	_, cleanup, err := NewWithCleanup(withPool(pool), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+	logger.messages = nil
+
+	// RUN
+	cleanup()
+
+	// ASSERT
+	if len(logger.messages) != 1 {
+		t.Fatalf("cleanup should log the close error, got %v", logger.messages)
+	}
+}
+
+func Test_WithStrictResolver(t *testing.T) {
+	// SETUP
+	instance := &Instance{resource: fakeResource("strict")}
+	if err := WithStrictResolver()(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+	resolver := instance.makeResolver()
+
+	// RUN
+	_, unknownErr := resolver("glacier", "us-east-1")
+	_, knownErr := resolver("s3", "us-east-1")
+
+	// ASSERT
+	if unknownErr == nil {
+		t.Fatalf("strict resolver should reject services localstack doesn't serve")
+	}
+
+	if knownErr != nil {
+		t.Fatalf("unexpected error resolving s3: %s", knownErr)
+	}
+}
+
+func Test_WithInitScripts(t *testing.T) {
+	// SETUP
+	dir, err := ioutil.TempDir("", "localstack-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	instance := &Instance{}
+
+	// RUN
+	if err := WithInitScripts(dir)(instance); err != nil {
+		t.Fatalf("unexpected error mounting init scripts: %s", err)
+	}
+
+	missingErr := WithInitScripts(dir + "/missing")(&Instance{})
+
+	// ASSERT
+	if !contains(instance.runOptions().Mounts, dir+":"+containerInitDir) {
+		t.Fatalf("expected init scripts mount, got %v", instance.runOptions().Mounts)
+	}
+
+	if missingErr == nil {
+		t.Fatalf("a missing init scripts directory should be rejected")
+	}
+}
+
+func Test_WithServices(t *testing.T) {
+	// SETUP
+	instance := &Instance{}
+
+	// RUN
+	validErr := WithServices(ServiceSQS, ServiceDynamoDB, "SNS")(instance)
+	_, unknownErr := New(withPool(&fakePool{}), WithServices(ServiceSQS, "dynamdb"))
+
+	// ASSERT
+	if validErr != nil {
+		t.Fatalf("unexpected error for valid services: %s", validErr)
+	}
+
+	if result := instance.serviceString(); result != "SERVICES=sqs,dynamodb,sns,s3" {
+		t.Fatalf("unexpected service string %q", result)
+	}
+
+	if unknownErr == nil {
+		t.Fatalf("unknown services should be rejected")
+	}
+}
+
+func Test_WithLabels(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithLabels(map[string]string{"project": "foo"}), WithLabels(map[string]string{"ci-run": "1234"}))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	labels := pool.runs[0].Labels
+	if labels["project"] != "foo" || labels["ci-run"] != "1234" {
+		t.Fatalf("expected labels on the run options, got %v", labels)
+	}
+}
+
+func Test_SigningRegion(t *testing.T) {
+	// SETUP
+	regional := &Instance{resource: fakeResource("regional")}
+	overridden := &Instance{resource: fakeResource("overridden")}
+	if err := WithRegion("eu-west-1")(regional); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WithSigningRegion("us-east-1")(overridden); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WithRegion("eu-west-1")(overridden); err != nil {
+		t.Fatal(err)
+	}
+
+	withDefaults(regional)
+	withDefaults(overridden)
+
+	// RUN
+	regionalEndpoint, regionalErr := regional.makeResolver()("sqs", "eu-west-1")
+	overriddenEndpoint, overriddenErr := overridden.makeResolver()("s3", "eu-west-1")
+
+	// ASSERT
+	if regionalErr != nil || overriddenErr != nil {
+		t.Fatalf("unexpected resolver errors: %v, %v", regionalErr, overriddenErr)
+	}
+
+	if regionalEndpoint.SigningRegion != "eu-west-1" {
+		t.Fatalf("signing region should track the instance region, got %q", regionalEndpoint.SigningRegion)
+	}
+
+	if overriddenEndpoint.SigningRegion != "us-east-1" {
+		t.Fatalf("signing region should use the override, got %q", overriddenEndpoint.SigningRegion)
+	}
+}
+
+func Test_SigningRegionPerRegion(t *testing.T) {
+	// SETUP
+	instance := &Instance{resource: fakeResource("regions")}
+	withDefaults(instance)
+	resolver := instance.makeResolver()
+
+	// RUN
+	east, eastErr := resolver("sqs", "us-east-1")
+	west, westErr := resolver("sqs", "eu-west-1")
+	unset, unsetErr := resolver("sqs", "")
+
+	// ASSERT
+	if eastErr != nil || westErr != nil || unsetErr != nil {
+		t.Fatalf("unexpected resolver errors: %v, %v, %v", eastErr, westErr, unsetErr)
+	}
+
+	if east.URL != west.URL {
+		t.Fatalf("every region should share the localstack endpoint, got %s and %s", east.URL, west.URL)
+	}
+
+	if east.SigningRegion != "us-east-1" || west.SigningRegion != "eu-west-1" {
+		t.Fatalf("expected each region to sign for itself, got %q and %q", east.SigningRegion, west.SigningRegion)
+	}
+
+	if unset.SigningRegion != instance.region {
+		t.Fatalf("expected the instance region without a client region, got %q", unset.SigningRegion)
+	}
+}
+
+func Test_ConfigWithBase(t *testing.T) {
+	// SETUP
+	instance := &Instance{resource: fakeResource("base")}
+	withDefaults(instance)
+	instance.resolver = instance.makeResolver()
+
+	retryer := aws.DefaultRetryer{NumMaxRetries: 7}
+	base := aws.Config{
+		Retryer:          retryer,
+		EndpointResolver: aws.ResolveWithEndpointURL("https://real.aws.example.com"),
+	}
+
+	// RUN
+	cfg := instance.ConfigWithBase(base)
+	endpoint, err := cfg.EndpointResolver.ResolveEndpoint("s3", "us-east-1")
+
+	// ASSERT
+	if cfg.Retryer != retryer {
+		t.Fatalf("the base retryer should survive, got %v", cfg.Retryer)
+	}
+
+	if err != nil {
+		t.Fatalf("unexpected error resolving s3: %s", err)
+	}
+
+	if endpoint.URL != "http://localhost:14566" {
+		t.Fatalf("the resolver should be replaced by localstack's, got %q", endpoint.URL)
+	}
+
+	if cfg.Region != "us-east-1" {
+		t.Fatalf("the instance region should be used when the base has none, got %q", cfg.Region)
+	}
+}
+
+func Test_WithGatewayPort(t *testing.T) {
+	// SETUP
+	resource := fakeResource("gateway")
+	resource.Container.NetworkSettings.Ports["5000/tcp"] = []docker.PortBinding{{HostIP: "0.0.0.0", HostPort: "15000"}}
+
+	instance := &Instance{portMode: PortModeEdge, resource: resource}
+	if err := WithGatewayPort(5000)(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+
+	// RUN
+	endpoint, err := instance.makeResolver()("s3", "us-east-1")
+	runOpts := instance.runOptions()
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error resolving s3: %s", err)
+	}
+
+	if endpoint.URL != "http://localhost:15000" {
+		t.Fatalf("resolver should use the custom gateway port, got %q", endpoint.URL)
+	}
+
+	if !contains(runOpts.Env, "GATEWAY_LISTEN=0.0.0.0:5000") {
+		t.Fatalf("expected GATEWAY_LISTEN in run env, got %v", runOpts.Env)
+	}
+
+	if !contains(runOpts.ExposedPorts, "5000/tcp") {
+		t.Fatalf("expected the gateway port to be exposed, got %v", runOpts.ExposedPorts)
+	}
+}
+
+func Test_WaitForServicesProbes(t *testing.T) {
+	// SETUP
+	attempts := map[string]*int{"s3": new(int), "sqs": new(int), "dynamodb": new(int)}
+	failures := map[string]int{"s3": 0, "sqs": 2, "dynamodb": 4}
+
+	probes := map[string]func(ctx context.Context, i *Instance) error{}
+	for service := range attempts {
+		service := service
+		probes[service] = func(ctx context.Context, i *Instance) error {
+			*attempts[service]++
+			if *attempts[service] <= failures[service] {
+				return errors.New("not ready")
+			}
+
+			return nil
+		}
+	}
+
+	instance := &Instance{probes: probes}
+	if err := WithServices(ServiceSQS, ServiceDynamoDB)(instance); err != nil {
+		t.Fatal(err)
+	}
+	instance.serviceString()
+	withDefaults(instance)
+	instance.sleep = func(d time.Duration) {}
+
+	// RUN
+	err := instance.WaitForServices(time.Minute)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error waiting for services: %s", err)
+	}
+
+	for service, count := range attempts {
+		if *count != failures[service]+1 {
+			t.Fatalf("expected %s to be probed until ready, got %d attempts", service, *count)
+		}
+	}
+}
+
+func Test_WaitForServicesTimeout(t *testing.T) {
+	// SETUP
+	probes := map[string]func(ctx context.Context, i *Instance) error{
+		"s3": func(ctx context.Context, i *Instance) error {
+			return nil
+		},
+		"sqs": func(ctx context.Context, i *Instance) error {
+			return errors.New("connection refused")
+		},
+	}
+
+	instance := &Instance{probes: probes, services: []string{"sqs", "s3"}}
+	withDefaults(instance)
+
+	// RUN
+	err := instance.WaitForServices(300 * time.Millisecond)
+
+	// ASSERT
+	if err == nil {
+		t.Fatalf("wait should time out when a service never responds")
+	}
+
+	if !strings.Contains(err.Error(), "sqs: connection refused") || strings.Contains(err.Error(), "s3") {
+		t.Fatalf("error should only name the failing service, got %q", err)
+	}
+}
+
+func Test_WithRandomRegion(t *testing.T) {
+	// SETUP
+	logger := &fakeLogger{}
+
+	// RUN
+	instance, err := New(withPool(&fakePool{}), WithLogger(logger), WithRandomRegion())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if !contains(regions, instance.Region()) {
+		t.Fatalf("random region %q should be one of the known regions", instance.Region())
+	}
+
+	if instance.Config().Region != instance.Region() {
+		t.Fatalf("config region should match the chosen region")
+	}
+
+	// the ports are logged right after the region
+	if len(logger.messages) != 2 || !strings.Contains(logger.messages[0], instance.Region()) {
+		t.Fatalf("the chosen region should be logged, got %v", logger.messages)
+	}
+}
+
+func Test_Region(t *testing.T) {
+	// SETUP
+	defaulted, defaultErr := New(withPool(&fakePool{}))
+	configured, configuredErr := New(withPool(&fakePool{}), WithRegion("ap-southeast-2"))
+	if defaultErr != nil || configuredErr != nil {
+		t.Fatalf("unexpected errors creating instances: %v, %v", defaultErr, configuredErr)
+	}
+
+	// RUN
+	defaultRegion := defaulted.Region()
+	configuredRegion := configured.Region()
+
+	// ASSERT
+	if defaultRegion != "us-east-1" {
+		t.Fatalf("expected the default region us-east-1, got %q", defaultRegion)
+	}
+
+	if configuredRegion != "ap-southeast-2" {
+		t.Fatalf("expected the configured region ap-southeast-2, got %q", configuredRegion)
+	}
+}
+
+func Test_WithRetries(t *testing.T) {
+	// SETUP
+	instance := &Instance{}
+	if err := WithRetries(5)(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+
+	// RUN
+	cfg := instance.Config()
+
+	// ASSERT
+	retryer, ok := cfg.Retryer.(aws.DefaultRetryer)
+	if !ok {
+		t.Fatalf("config should carry a default retryer, got %T", cfg.Retryer)
+	}
+
+	// the first attempt isn't a retry
+	if retryer.MaxRetries() != 4 {
+		t.Fatalf("expected 4 retries for 5 attempts, got %d", retryer.MaxRetries())
+	}
+
+	if err := WithRetries(0)(&Instance{}); err == nil {
+		t.Fatalf("fewer than 1 attempt should be rejected")
+	}
+}
+
+func Test_WithImage(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	repository := "myregistry.example.com/localstack/localstack"
+
+	// RUN
+	_, err := New(withPool(pool), WithImage(repository), WithImageTag("0.10.7"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if pool.runs[0].Repository != repository || pool.runs[0].Tag != "0.10.7" {
+		t.Fatalf("expected %s:0.10.7 to be run, got %s:%s", repository, pool.runs[0].Repository, pool.runs[0].Tag)
+	}
+}
+
+func Test_WithRegistryAuth(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithImage("registry.example.com/localstack"), WithRegistryAuth("user", "pass", "registry.example.com"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	auth := pool.runs[0].Auth
+	if auth.Username != "user" || auth.Password != "pass" || auth.ServerAddress != "registry.example.com" {
+		t.Fatalf("registry auth should be threaded into the run options, got %+v", auth)
+	}
+}
+
+func Test_MissingRegistryAuth(t *testing.T) {
+	// SETUP
+	pullErr := errors.New("API error (500): Get https://registry.example.com/v2/: unauthorized: authentication required")
+	pool := &fakePool{runErrs: []error{pullErr}}
+
+	// RUN
+	_, err := New(withPool(pool), WithImage("registry.example.com/localstack"))
+
+	// ASSERT
+	if err == nil || !strings.Contains(err.Error(), "WithRegistryAuth") {
+		t.Fatalf("expected an error pointing at WithRegistryAuth, got %v", err)
+	}
+
+	if !errors.Is(err, pullErr) {
+		t.Fatalf("the pull error should be wrapped")
+	}
+}
+
+func Test_CloseOnPanic(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	instance, err := New(withPool(pool))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	var recovered interface{}
+	func() {
+		defer func() {
+			recovered = recover()
+		}()
+		defer instance.CloseOnPanic()
+
+		panic("boom")
+	}()
+
+	// ASSERT
+	if recovered != "boom" {
+		t.Fatalf("the original panic should be re-raised, got %v", recovered)
+	}
+
+	if len(pool.purged) != 1 {
+		t.Fatalf("the container should be purged on panic")
+	}
+}
+
+func Test_CloseOnPanicWithoutPanic(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	instance, err := New(withPool(pool))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	func() {
+		defer instance.CloseOnPanic()
+	}()
+
+	// ASSERT
+	if len(pool.purged) != 0 {
+		t.Fatalf("the container should be left alone when nothing panics")
+	}
+}
+
+func Test_SharedPool(t *testing.T) {
+	// RUN
+	first, firstErr := SharedPool()
+	second, secondErr := SharedPool()
+
+	// ASSERT
+	if firstErr != nil || secondErr != nil {
+		t.Fatalf("unexpected errors creating the shared pool: %v, %v", firstErr, secondErr)
+	}
+
+	if first != second {
+		t.Fatalf("SharedPool should always return the same pool")
+	}
+}
+
+func Test_WithDebug(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithDebug())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if !contains(pool.runs[0].Env, "DEBUG=1") {
+		t.Fatalf("expected DEBUG=1 in run env, got %v", pool.runs[0].Env)
+	}
+}
+
+func Test_WithOSEnvPassthrough(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	t.Setenv("TEST_LOCALSTACK_PASSTHROUGH", "forwarded")
+
+	// RUN
+	_, err := New(withPool(pool), WithOSEnvPassthrough("TEST_LOCALSTACK_PASSTHROUGH", "TEST_LOCALSTACK_MISSING"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	env := pool.runs[0].Env
+	if !contains(env, "TEST_LOCALSTACK_PASSTHROUGH=forwarded") {
+		t.Fatalf("expected the variable to be passed through, got %v", env)
+	}
+
+	for _, value := range env {
+		if strings.HasPrefix(value, "TEST_LOCALSTACK_MISSING") {
+			t.Fatalf("unset variables should be skipped, got %v", env)
+		}
+	}
+}
+
+func Test_WithHostnameExternal(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithHostnameExternal("localstack.test"))
+	invalidErr := WithHostnameExternal("")(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if !contains(pool.runs[0].Env, "HOSTNAME_EXTERNAL=localstack.test") {
+		t.Fatalf("expected HOSTNAME_EXTERNAL in run env, got %v", pool.runs[0].Env)
+	}
+
+	if invalidErr == nil {
+		t.Fatal("an empty hostname should be rejected")
+	}
+}
+
+func Test_WithEagerServices(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithEagerServices())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if !contains(pool.runs[0].Env, "EAGER_SERVICE_LOADING=1") {
+		t.Fatalf("expected EAGER_SERVICE_LOADING=1 in run env, got %v", pool.runs[0].Env)
+	}
+}
+
+func Test_WithEnv(t *testing.T) {
+	// SETUP
+	instance := &Instance{}
+
+	// RUN
+	firstErr := WithEnv("LS_LOG", "info")(instance)
+	secondErr := WithEnv("LS_LOG", "trace")(instance)
+	servicesErr := WithEnv("SERVICES", "sqs")(instance)
+
+	// ASSERT
+	if firstErr != nil || secondErr != nil {
+		t.Fatalf("unexpected errors setting env: %v, %v", firstErr, secondErr)
+	}
+
+	if !contains(instance.runOptions().Env, "LS_LOG=trace") || contains(instance.runOptions().Env, "LS_LOG=info") {
+		t.Fatalf("later values should replace earlier ones, got %v", instance.runOptions().Env)
+	}
+
+	if servicesErr == nil {
+		t.Fatalf("SERVICES should only be set through WithServices")
+	}
+}
+
+func Test_Services(t *testing.T) {
+	// SETUP
+	instance, err := New(withPool(&fakePool{}), WithServices(ServiceDynamoDB))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	services := instance.Services()
+	services[0] = "mutated"
+
+	// ASSERT
+	if len(services) != 2 || !contains(instance.Services(), "dynamodb") || !contains(instance.Services(), "s3") {
+		t.Fatalf("expected dynamodb and the forced s3, got %v", instance.Services())
+	}
+}
+
+func Test_WithSSL(t *testing.T) {
+	cases := []struct {
+		name string
+		host string
+	}{
+		{"default host", ""},
+		{"http host", "http://localhost"},
+		{"https host", "https://localhost"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// SETUP
+			instance := &Instance{resource: fakeResource("ssl"), host: c.host}
+			if err := WithSSL()(instance); err != nil {
+				t.Fatal(err)
+			}
+			withDefaults(instance)
+
+			// RUN
+			endpoint, err := instance.makeResolver()("s3", "us-east-1")
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error resolving s3: %s", err)
+			}
+
+			if !strings.HasPrefix(endpoint.URL, "https://localhost:") {
+				t.Fatalf("expected an https endpoint, got %q", endpoint.URL)
+			}
+
+			if !contains(instance.runOptions().Env, "USE_SSL=1") {
+				t.Fatalf("expected USE_SSL in run env, got %v", instance.runOptions().Env)
+			}
+		})
+	}
+}
+
+func Test_NewExternalSSL(t *testing.T) {
+	// SETUP
+	hosts := []string{"ls.example", "http://ls.example", "https://ls.example"}
+
+	for _, host := range hosts {
+		// RUN
+		instance, err := NewExternal(host, WithSSL())
+		if err != nil {
+			t.Fatalf("unexpected error creating external instance: %s", err)
+		}
+
+		endpoint, err := instance.Endpoint("s3")
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("unexpected error resolving s3: %s", err)
+		}
+
+		if endpoint != "https://ls.example:4566" {
+			t.Fatalf("expected %s to resolve to https://ls.example:4566, got %s", host, endpoint)
+		}
+	}
+}
+
+func Test_ResourceLimits(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithMemory(512*1024*1024), WithCPUShares(512))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if pool.hostConfigs[0].Memory != 512*1024*1024 {
+		t.Fatalf("expected the memory limit on the host config, got %d", pool.hostConfigs[0].Memory)
+	}
+
+	if pool.hostConfigs[0].CPUShares != 512 {
+		t.Fatalf("expected the cpu shares on the host config, got %d", pool.hostConfigs[0].CPUShares)
+	}
+}
+
+func Test_CloseWithTimeout(t *testing.T) {
+	// SETUP
+	pool := &fakePool{blockPurge: make(chan struct{})}
+	defer close(pool.blockPurge)
+
+	instance, err := New(withPool(pool))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	start := time.Now()
+	closeErr := instance.CloseWithTimeout(50 * time.Millisecond)
+
+	// ASSERT
+	if closeErr == nil {
+		t.Fatalf("close should time out when purge hangs")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("close should return once the timeout fires, took %s", elapsed)
+	}
+}
+
+func Test_CloseWithTimeoutCompletes(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	instance, err := New(withPool(pool))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	closeErr := instance.CloseWithTimeout(time.Second)
+
+	// ASSERT
+	if closeErr != nil {
+		t.Fatalf("unexpected error closing instance: %s", closeErr)
+	}
+
+	if len(pool.purged) != 1 {
+		t.Fatalf("the container should be purged")
+	}
+}
+
+const sampleHealth = `{
+	"services": {
+		"dynamodb": "available",
+		"s3": "running",
+		"sqs": "initializing"
+	},
+	"edition": "community",
+	"version": "3.0.2"
+}`
+
+// healthServer serves body from the given health path and 404s everywhere else.
+func healthServer(path, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+// serverInstance builds an Instance whose edge port maps to the given test server.
+func serverInstance(t *testing.T, server *httptest.Server, services ...string) *Instance {
+	parsed, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource := fakeResource("health")
+	resource.Container.NetworkSettings.Ports[edgePort] = []docker.PortBinding{{HostIP: "0.0.0.0", HostPort: parsed.Port()}}
+
+	instance := &Instance{host: "http://" + parsed.Hostname(), resource: resource, services: services}
+	withDefaults(instance)
+	return instance
+}
+
+func Test_RunningServices(t *testing.T) {
+	// SETUP
+	server := healthServer("/_localstack/health", sampleHealth)
+	defer server.Close()
+	instance := serverInstance(t, server)
+
+	// RUN
+	running, err := instance.RunningServices(context.TODO())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error fetching running services: %s", err)
+	}
+
+	// sqs is still initializing
+	if strings.Join(running, ",") != "dynamodb,s3" {
+		t.Fatalf("expected only the running and available services, got %v", running)
+	}
+}
+
+func Test_Health(t *testing.T) {
+	// SETUP
+	server := healthServer("/_localstack/health", sampleHealth)
+	defer server.Close()
+	instance := serverInstance(t, server)
+
+	// RUN
+	health, err := instance.Health(context.TODO())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error fetching health: %s", err)
+	}
+
+	expected := map[string]string{"dynamodb": "available", "s3": "running", "sqs": "initializing"}
+	if len(health) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, health)
+	}
+
+	for service, status := range expected {
+		if health[service] != status {
+			t.Fatalf("expected %s to be %q, got %q", service, status, health[service])
+		}
+	}
+}
+
+func Test_HealthLegacyPath(t *testing.T) {
+	// SETUP
+	server := healthServer("/health", sampleHealth)
+	defer server.Close()
+	instance := serverInstance(t, server)
+
+	// RUN
+	health, err := instance.Health(context.TODO())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error fetching health: %s", err)
+	}
+
+	if health["s3"] != "running" {
+		t.Fatalf("expected s3 to be running, got %v", health)
+	}
+}
+
+func Test_HealthReady(t *testing.T) {
+	// SETUP
+	server := healthServer("/_localstack/health", sampleHealth)
+	defer server.Close()
+
+	ready := serverInstance(t, server, "s3", "dynamodb")
+	notReady := serverInstance(t, server, "s3", "sqs")
+
+	// RUN
+	readyErr := healthReady(context.TODO(), ready)
+	notReadyErr := healthReady(context.TODO(), notReady)
+
+	// ASSERT
+	if readyErr != nil {
+		t.Fatalf("running and available services should be ready: %s", readyErr)
+	}
+
+	if notReadyErr == nil {
+		t.Fatalf("initializing services should not be ready")
+	}
+}
+
+// latestHealth is the health response of the latest image with every service enabled.
+const latestHealth = `{
+	"services": {
+		"apigateway": "available", "cloudformation": "available", "cloudwatch": "available", "dynamodb": "available",
+		"dynamodbstreams": "available", "ec2": "available", "es": "available", "events": "available",
+		"firehose": "available", "iam": "available", "kinesis": "available", "lambda": "available",
+		"logs": "available", "redshift": "available", "route53": "available", "s3": "available",
+		"secretsmanager": "available", "ses": "available", "sns": "available", "sqs": "available",
+		"ssm": "available", "stepfunctions": "available", "sts": "available"
+	}
+}`
+
+func Test_HealthReadyAllServices(t *testing.T) {
+	// SETUP
+	server := healthServer("/_localstack/health", latestHealth)
+	defer server.Close()
+
+	instance := serverInstance(t, server)
+	if err := WithAllServices()(instance); err != nil {
+		t.Fatal(err)
+	}
+	instance.normalizeServices()
+
+	// RUN
+	err := healthReady(context.TODO(), instance)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("every service from WithAllServices should be found in the health response: %s", err)
+	}
+}
+
+func Test_WithHostNetwork(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	instance, err := New(withPool(pool), WithHostNetwork(), WithPortMode(PortModeEdge))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	endpoint, resolveErr := instance.resolver("sqs", "us-east-1")
+
+	// ASSERT
+	if pool.hostConfigs[0].NetworkMode != "host" {
+		t.Fatalf("expected host network mode, got %q", pool.hostConfigs[0].NetworkMode)
+	}
+
+	if resolveErr != nil {
+		t.Fatalf("unexpected error resolving sqs: %s", resolveErr)
+	}
+
+	if endpoint.URL != "http://localhost:4566" {
+		t.Fatalf("resolver should use the raw container port, got %q", endpoint.URL)
+	}
+}
+
+func Test_WithLambdaExecutor(t *testing.T) {
+	cases := []struct {
+		mode  string
+		mount bool
+	}{
+		{"local", false},
+		{"docker", true},
+		{"docker-reuse", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.mode, func(t *testing.T) {
+			// SETUP
+			instance := &Instance{}
+
+			// RUN
+			err := WithLambdaExecutor(c.mode)(instance)
+			runOpts := instance.runOptions()
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error setting lambda executor: %s", err)
+			}
+
+			if !contains(runOpts.Env, "LAMBDA_EXECUTOR="+c.mode) {
+				t.Fatalf("expected LAMBDA_EXECUTOR in run env, got %v", runOpts.Env)
+			}
+
+			if mounted := contains(runOpts.Mounts, dockerSocket+":"+dockerSocket); mounted != c.mount {
+				t.Fatalf("expected docker socket mounted to be %t, got mounts %v", c.mount, runOpts.Mounts)
+			}
+		})
+	}
+
+	if err := WithLambdaExecutor("kubernetes")(&Instance{}); err == nil {
+		t.Fatalf("unknown lambda executors should be rejected")
+	}
+}
+
+func Test_NewRetriesRateLimits(t *testing.T) {
+	// SETUP
+	rateLimited := errors.New("toomanyrequests: You have reached your pull rate limit.")
+	pool := &fakePool{runErrs: []error{rateLimited, rateLimited}}
+	delays := []time.Duration{}
+	clock := func(i *Instance) error {
+		i.sleep = func(d time.Duration) { delays = append(delays, d) }
+		return nil
+	}
+
+	// RUN
+	instance, err := New(withPool(pool), clock)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("New should retry rate limited pulls, got: %s", err)
+	}
+
+	if instance.resource == nil || len(pool.runs) != 3 {
+		t.Fatalf("expected the third run attempt to succeed, got %d attempts", len(pool.runs))
+	}
+
+	if len(delays) != 2 || delays[1] <= delays[0] {
+		t.Fatalf("rate limited pulls should back off, got delays %v", delays)
+	}
+}
+
+func Test_NewGivesUpOnRateLimits(t *testing.T) {
+	// SETUP
+	rateLimited := errors.New("toomanyrequests: You have reached your pull rate limit.")
+	pool := &fakePool{runErrs: []error{rateLimited, rateLimited, rateLimited}}
+
+	// RUN
+	_, err := New(withPool(pool), noSleep)
+
+	// ASSERT
+	if err == nil {
+		t.Fatalf("New should give up after %d attempts", maxRunAttempts)
+	}
+
+	if len(pool.runs) != maxRunAttempts {
+		t.Fatalf("expected %d run attempts, got %d", maxRunAttempts, len(pool.runs))
+	}
+}
+
+func Test_WithExtraHosts(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithExtraHosts("host.docker.internal:host-gateway", "db.local:10.0.0.2"))
+	invalidErr := WithExtraHosts("missing-ip")(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	hosts := pool.runs[0].ExtraHosts
+	if !contains(hosts, "host.docker.internal:host-gateway") || !contains(hosts, "db.local:10.0.0.2") {
+		t.Fatalf("expected extra hosts in run options, got %v", hosts)
+	}
+
+	if invalidErr == nil {
+		t.Fatalf("extra hosts without an ip should be rejected")
+	}
+}
+
+func Test_WithHostGateway(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithExtraHosts("db.local:10.0.0.2"), WithHostGateway())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	hosts := pool.runs[0].ExtraHosts
+	if !contains(hosts, "host.docker.internal:host-gateway") || !contains(hosts, "db.local:10.0.0.2") {
+		t.Fatalf("expected the host gateway alongside other extra hosts, got %v", hosts)
+	}
+}
+
+func Test_WithPathPrefix(t *testing.T) {
+	for _, prefix := range []string{"localstack", "/localstack", "localstack/", "//localstack//"} {
+		t.Run(prefix, func(t *testing.T) {
+			// SETUP
+			instance := &Instance{resource: fakeResource("prefix"), portMode: PortModeEdge}
+			if err := WithPathPrefix(prefix)(instance); err != nil {
+				t.Fatal(err)
+			}
+			withDefaults(instance)
+
+			// RUN
+			endpoint, err := instance.makeResolver()("s3", "us-east-1")
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error resolving s3: %s", err)
+			}
+
+			if endpoint.URL != "http://localhost:14566/localstack" {
+				t.Fatalf("expected the prefix exactly once, got %q", endpoint.URL)
+			}
+		})
+	}
+}
+
+func Test_ResolverConcurrency(t *testing.T) {
+	// SETUP
+	instance := &Instance{resource: fakeResource("concurrent"), portMode: PortModeLegacy}
+	withDefaults(instance)
+	resolver := instance.makeResolver()
+	services := []string{"s3", "sqs", "dynamodb", "sns", "kinesis"}
+
+	// RUN
+	errs := make(chan error, 50)
+	for idx := 0; idx < cap(errs); idx++ {
+		go func(service string) {
+			_, err := resolver(service, "us-east-1")
+			errs <- err
+		}(services[idx%len(services)])
+	}
+
+	// ASSERT
+	for idx := 0; idx < cap(errs); idx++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error resolving concurrently: %s", err)
+		}
+	}
+
+	if len(instance.ports) != len(services) {
+		t.Fatalf("expected a cached port per service, got %v", instance.ports)
+	}
+}
+
+func Test_SetResourceInvalidatesPorts(t *testing.T) {
+	// SETUP
+	instance := &Instance{portMode: PortModeEdge}
+	withDefaults(instance)
+	instance.setResource(fakeResource("first"))
+	first := instance.url(edgePort)
+
+	restarted := fakeResource("second")
+	restarted.Container.NetworkSettings.Ports[edgePort] = []docker.PortBinding{{HostIP: "0.0.0.0", HostPort: "20000"}}
+
+	// RUN
+	instance.setResource(restarted)
+	second := instance.url(edgePort)
+
+	// ASSERT
+	if first == second || second != "http://localhost:20000" {
+		t.Fatalf("ports should be looked up again for a new resource, got %q then %q", first, second)
+	}
+}
+
+func Benchmark_Resolver(b *testing.B) {
+	instance := &Instance{resource: fakeResource("bench"), portMode: PortModeEdge}
+	withDefaults(instance)
+	resolver := instance.makeResolver()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _ = resolver("s3", "us-east-1")
+	}
+}
+
+func Test_WithCmd(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithCmd("/scripts/wrapper.sh", "--verbose"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	runOpts := pool.runs[0]
+	if len(runOpts.Entrypoint) != 1 || runOpts.Entrypoint[0] != "/scripts/wrapper.sh" {
+		t.Fatalf("expected the command to replace the entrypoint, got %v", runOpts.Entrypoint)
+	}
+
+	if len(runOpts.Cmd) != 1 || runOpts.Cmd[0] != "--verbose" {
+		t.Fatalf("expected the command arguments, got %v", runOpts.Cmd)
+	}
+
+	if err := WithCmd()(&Instance{}); err == nil {
+		t.Fatalf("an empty command should be rejected")
+	}
+}
+
+func Test_WithStartupHook(t *testing.T) {
+	// SETUP
+	calls := 0
+	hook := func(ctx context.Context, i *Instance) error {
+		calls++
+		return nil
+	}
+	ready := func(ctx context.Context, i *Instance) error {
+		return nil
+	}
+
+	instance, err := New(withPool(&fakePool{}), WithHealthCheck(ready), WithStartupHook(hook))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	callsBeforeWait := calls
+	firstErr := instance.Wait(time.Second)
+	secondErr := instance.Wait(time.Second)
+
+	// ASSERT
+	if callsBeforeWait != 0 {
+		t.Fatalf("hooks should not run before localstack is ready")
+	}
+
+	if firstErr != nil || secondErr != nil {
+		t.Fatalf("unexpected errors waiting: %v, %v", firstErr, secondErr)
+	}
+
+	if calls != 1 {
+		t.Fatalf("hooks should run exactly once, ran %d times", calls)
+	}
+}
+
+func Test_WithStartupHookFailure(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	hookErr := errors.New("bucket already exists")
+	hook := func(ctx context.Context, i *Instance) error {
+		return hookErr
+	}
+	ready := func(ctx context.Context, i *Instance) error {
+		return nil
+	}
+
+	// RUN
+	_, err := New(withPool(pool), WithHealthCheck(ready), WithStartupHook(hook), WithStartupTimeout(time.Second))
+
+	// ASSERT
+	if !errors.Is(err, hookErr) {
+		t.Fatalf("New should fail with the hook error, got %v", err)
+	}
+
+	if len(pool.purged) != 1 {
+		t.Fatalf("the container should be purged when a startup hook fails")
+	}
+}
+
+func Test_WithS3PathStyle(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     []InstanceOpt
+		expected bool
+	}{
+		{"default", nil, true},
+		{"path style", []InstanceOpt{WithS3PathStyle(true)}, true},
+		{"virtual host", []InstanceOpt{WithS3PathStyle(false)}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// SETUP
+			instance, err := New(append([]InstanceOpt{withPool(&fakePool{})}, c.opts...)...)
+			if err != nil {
+				t.Fatalf("unexpected error creating instance: %s", err)
+			}
+
+			// RUN
+			client := instance.S3Client()
+
+			// ASSERT
+			if client.ForcePathStyle != c.expected {
+				t.Fatalf("expected ForcePathStyle to be %t", c.expected)
+			}
+		})
+	}
+}
+
+func Test_WithPlatform(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithPlatform("linux/amd64"))
+	invalidErr := WithPlatform("amd64")(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if pool.runs[0].Platform != "linux/amd64" {
+		t.Fatalf("expected the platform in the run options, got %q", pool.runs[0].Platform)
+	}
+
+	if invalidErr == nil {
+		t.Fatalf("platforms without an os should be rejected")
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	// SETUP
+	empty := &Instance{}
+	configured := &Instance{services: []string{"sqs"}}
+
+	// RUN
+	emptyErr := empty.validate()
+	configuredErr := configured.validate()
+
+	// ASSERT
+	if !errors.Is(emptyErr, ErrNoServices) {
+		t.Fatalf("expected ErrNoServices for an instance without services, got %v", emptyErr)
+	}
+
+	if configuredErr != nil {
+		t.Fatalf("unexpected error validating configured instance: %s", configuredErr)
+	}
+}
+
+func Test_NewWithoutServices(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithoutForcedS3())
+
+	// ASSERT
+	if !errors.Is(err, ErrNoServices) {
+		t.Fatalf("expected ErrNoServices, got %v", err)
+	}
+
+	if len(pool.runs) != 0 {
+		t.Fatalf("no container should be started without services")
+	}
+}
+
+func Test_WithoutForcedS3(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	check := WithHealthCheck(func(ctx context.Context, i *Instance) error {
+		return nil
+	})
+
+	// RUN
+	instance, err := New(withPool(pool), WithServices(ServiceSQS), WithoutForcedS3(), check)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if !contains(pool.runs[0].Env, "SERVICES=sqs") {
+		t.Fatalf("expected only sqs to be enabled, got %v", pool.runs[0].Env)
+	}
+
+	if services := instance.Services(); len(services) != 1 || services[0] != "sqs" {
+		t.Fatalf("s3 should not be forced, got %v", services)
+	}
+}
+
+func Test_WithFixedPort(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	instance, err := New(withPool(pool), WithPortMode(PortModeEdge), WithFixedPort(4566, 4566))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	endpoint, endpointErr := instance.Endpoint("s3")
+
+	// ASSERT
+	bindings := pool.runs[0].PortBindings[docker.Port(edgePort)]
+	if len(bindings) != 1 || bindings[0].HostPort != "4566" {
+		t.Fatalf("expected the edge port to be bound to 4566, got %v", pool.runs[0].PortBindings)
+	}
+
+	if endpointErr != nil {
+		t.Fatalf("unexpected error resolving s3: %s", endpointErr)
+	}
+
+	if endpoint != "http://localhost:4566" {
+		t.Fatalf("expected the endpoint to use the fixed port, got %q", endpoint)
+	}
+}
+
+func Test_WithInitTimeout(t *testing.T) {
+	// SETUP
+	pool := &fakePool{blockRun: make(chan struct{})}
+	defer close(pool.blockRun)
+
+	// RUN
+	_, err := New(withPool(pool), WithInitTimeout(10*time.Millisecond), WithStartupTimeout(time.Hour))
+
+	// ASSERT
+	if err == nil || !strings.Contains(err.Error(), "starting localstack container") {
+		t.Fatalf("expected the init timeout to fire, got %v", err)
+	}
+
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		t.Fatal("the init timeout should not be reported as a readiness timeout")
+	}
+}
+
+func Test_WithInitTimeoutSeparateFromStartup(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	now := time.Now()
+	clock := func(i *Instance) error {
+		i.now = func() time.Time { return now }
+		i.sleep = func(d time.Duration) { now = now.Add(d) }
+		return nil
+	}
+	notReady := WithHealthCheck(func(ctx context.Context, i *Instance) error {
+		return errors.New("not ready")
+	})
+
+	// RUN
+	_, err := New(withPool(pool), clock, notReady, WithInitTimeout(time.Minute), WithStartupTimeout(5*time.Second))
+
+	// ASSERT
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected a readiness timeout, got %v", err)
+	}
+
+	if timeoutErr.Elapsed != 5*time.Second {
+		t.Fatalf("readiness should get its full budget, got %s", timeoutErr.Elapsed)
+	}
+
+	if len(pool.purged) != 1 {
+		t.Fatalf("expected the container to be purged, got %d purges", len(pool.purged))
+	}
+}
+
+func Test_WithCleanVolumes(t *testing.T) {
+	// SETUP
+	mounts := WithRunOptions(func(opts *dockertest.RunOptions) {
+		opts.Mounts = append(opts.Mounts, "localstack-cache:/var/lib/localstack", "shared-fixtures:/fixtures", "/tmp/data:/data")
+	})
+
+	for _, clean := range []bool{true, false} {
+		pool := &fakePool{}
+		client := &fakeClient{volumes: []string{"shared-fixtures"}}
+		opts := []InstanceOpt{withPool(pool), withClient(client), mounts}
+		if clean {
+			opts = append(opts, WithCleanVolumes())
+		}
+
+		instance, err := New(opts...)
+		if err != nil {
+			t.Fatalf("unexpected error creating instance: %s", err)
+		}
+
+		// the container's volume is already gone by the time Close gets to it
+		client.removeErr = docker.ErrNoSuchVolume
+
+		// RUN
+		err = instance.Close()
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("volumes that are already gone should be ignored, got %s", err)
+		}
+
+		if len(pool.purged) != 1 {
+			t.Fatalf("expected the container to be purged, got %d purges", len(pool.purged))
+		}
+
+		if clean && strings.Join(client.removedVolumes, ",") != "localstack-cache" {
+			t.Fatalf("expected only the volume created for the container to be removed, got %v", client.removedVolumes)
+		}
+
+		if !clean && len(client.removedVolumes) != 0 {
+			t.Fatalf("volumes should only be removed with WithCleanVolumes, got %v", client.removedVolumes)
+		}
+	}
+}
+
+func Test_PortMap(t *testing.T) {
+	// SETUP
+	logger := &fakeLogger{}
+	services := []Service{ServiceS3, ServiceSQS, ServiceDynamoDB}
+	for _, mode := range []PortMode{PortModeEdge, PortModeLegacy} {
+		instance, err := New(withPool(&fakePool{}), WithPortMode(mode), WithServices(services...), WithLogger(logger))
+		if err != nil {
+			t.Fatalf("unexpected error creating instance: %s", err)
+		}
+
+		// RUN
+		ports := instance.PortMap()
+
+		// ASSERT
+		if len(ports) != len(services) {
+			t.Fatalf("expected a port for each service, got %v", ports)
+		}
+
+		for _, service := range services {
+			if ports[string(service)] == "" {
+				t.Fatalf("expected a port for %s, got %v", service, ports)
+			}
+		}
+
+		if mode == PortModeEdge && ports["sqs"] != "14566" {
+			t.Fatalf("expected services to share the edge port, got %v", ports)
+		}
+
+		if mode == PortModeLegacy && ports["sqs"] != "1"+strings.TrimSuffix(legacyPorts["sqs"], "/tcp") {
+			t.Fatalf("expected sqs to use its legacy port, got %v", ports)
+		}
+	}
+
+	if len(logger.messages) != 2 || !strings.Contains(logger.messages[0], "sqs:14566") {
+		t.Fatalf("expected the ports to be logged, got %v", logger.messages)
+	}
+}
+
+func Test_WithServicesFromEnv(t *testing.T) {
+	// SETUP
+	t.Setenv("TEST_LOCALSTACK_SERVICES", " SQS, dynamodb,,sns ")
+
+	// RUN
+	instance, err := New(withPool(&fakePool{}), WithServicesFromEnv("TEST_LOCALSTACK_SERVICES"))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	unset, unsetErr := New(withPool(&fakePool{}), WithServices(ServiceSQS), WithServicesFromEnv("TEST_LOCALSTACK_UNSET"))
+
+	t.Setenv("TEST_LOCALSTACK_SERVICES", "sqs,nope")
+	_, invalidErr := New(withPool(&fakePool{}), WithServicesFromEnv("TEST_LOCALSTACK_SERVICES"))
+
+	// ASSERT
+	expected := []string{"sqs", "dynamodb", "sns", "s3"}
+	if services := instance.Services(); strings.Join(services, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected services %v, got %v", expected, services)
+	}
+
+	if unsetErr != nil {
+		t.Fatalf("unexpected error creating instance: %s", unsetErr)
+	}
+
+	if services := unset.Services(); strings.Join(services, ",") != "sqs,s3" {
+		t.Fatalf("an unset variable should keep the configured services, got %v", services)
+	}
+
+	if invalidErr == nil || !strings.Contains(invalidErr.Error(), "TEST_LOCALSTACK_SERVICES") {
+		t.Fatalf("expected an error naming the variable, got %v", invalidErr)
+	}
+}
+
+func Test_WithPlatformFallback(t *testing.T) {
+	// SETUP
+	mismatch := errors.New("no matching manifest for linux/arm64/v8 in the manifest list entries")
+	pool := &fakePool{runErrs: []error{mismatch}}
+	strict := &fakePool{runErrs: []error{mismatch}}
+
+	// RUN
+	_, err := New(withPool(pool), WithPlatform("linux/arm64"), WithPlatformFallback(), WithLogger(&fakeLogger{}))
+	_, strictErr := New(withPool(strict), WithPlatform("linux/arm64"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if len(pool.runs) != 2 || pool.runs[0].Platform != "linux/arm64" || pool.runs[1].Platform != "linux/amd64" {
+		t.Fatalf("expected a native run followed by an amd64 retry")
+	}
+
+	if !errors.Is(strictErr, mismatch) || len(strict.runs) != 1 {
+		t.Fatalf("without the fallback the mismatch should fail fast, got %v", strictErr)
+	}
+}
+
+func Test_ConfigContext(t *testing.T) {
+	// SETUP
+	type key struct{}
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		_, _ = w.Write([]byte("<ListAllMyBucketsResult></ListAllMyBucketsResult>"))
+	}))
+	defer server.Close()
+
+	instance := serverInstance(t, server, "s3")
+	instance.resolver = instance.makeResolver()
+	ctx := context.WithValue(context.Background(), key{}, "trace-id")
+
+	cfg := instance.ConfigContext(ctx)
+	var seen interface{}
+	cfg.Handlers.Send.PushFront(func(r *aws.Request) {
+		seen = r.Context().Value(key{})
+	})
+
+	// RUN
+	_, err := s3.New(cfg).ListBucketsRequest(&s3.ListBucketsInput{}).Send(context.Background())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error listing buckets: %s", err)
+	}
+
+	if len(paths) != 1 {
+		t.Fatalf("expected the resolver to point the client at localstack, got %d requests", len(paths))
+	}
+
+	if seen != "trace-id" {
+		t.Fatalf("expected context values to reach the request, got %v", seen)
+	}
+}
+
+func Test_WithStartupProbeInterval(t *testing.T) {
+	// SETUP
+	now := time.Now()
+	probes := 0
+	instance := &Instance{
+		healthCheck: func(ctx context.Context, i *Instance) error {
+			probes++
+			return errors.New("not ready")
+		},
+		now:   func() time.Time { return now },
+		sleep: func(d time.Duration) { now = now.Add(d) },
+	}
+	if err := WithStartupProbeInterval(250 * time.Millisecond)(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+
+	// RUN
+	err := instance.Wait(time.Second)
+	invalidErr := WithStartupProbeInterval(0)(&Instance{})
+
+	// ASSERT
+	if err == nil {
+		t.Fatal("wait should have timed out")
+	}
+
+	// probes at 0, 250ms, 500ms, 750ms and 1s
+	if probes != 5 {
+		t.Fatalf("expected 5 probes over a second, got %d", probes)
+	}
+
+	if invalidErr == nil {
+		t.Fatal("a non-positive interval should be rejected")
+	}
+}
+
+func Test_NewExternal(t *testing.T) {
+	// SETUP
+	server := healthServer("/_localstack/health", sampleHealth)
+	defer server.Close()
+
+	// RUN
+	instance, err := NewExternal(server.URL, WithServices(ServiceDynamoDB), WithStartupTimeout(time.Second))
+	fallback, fallbackErr := NewExternal("localstack")
+	_, invalidErr := NewExternal("localstack:4566/path")
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating external instance: %s", err)
+	}
+
+	endpoint, err := instance.Config().EndpointResolver.ResolveEndpoint("dynamodb", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error resolving dynamodb: %s", err)
+	}
+
+	if endpoint.URL != server.URL {
+		t.Fatalf("expected dynamodb at %s, got %s", server.URL, endpoint.URL)
+	}
+
+	if err := instance.Close(); err != nil {
+		t.Fatalf("closing an external instance should be a no-op, got %s", err)
+	}
+
+	if fallbackErr != nil {
+		t.Fatalf("unexpected error creating external instance: %s", fallbackErr)
+	}
+
+	if url, _ := fallback.Endpoint("s3"); url != "http://localstack:4566" {
+		t.Fatalf("expected the edge port by default, got %s", url)
+	}
+
+	if invalidErr == nil {
+		t.Fatal("hosts with a path should be rejected")
+	}
+}
+
+func Test_EndpointResolver(t *testing.T) {
+	// SETUP
+	instance, err := New(withPool(&fakePool{}), WithServices(ServiceSQS))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	resolved, resolvedErr := instance.EndpointResolver().ResolveEndpoint("s3", "us-east-1")
+	configured, configuredErr := instance.Config().EndpointResolver.ResolveEndpoint("s3", "us-east-1")
+
+	// ASSERT
+	if resolvedErr != nil || configuredErr != nil {
+		t.Fatalf("unexpected error resolving s3: %v, %v", resolvedErr, configuredErr)
+	}
+
+	if resolved != configured {
+		t.Fatalf("expected the exported resolver to match Config's, got %+v and %+v", resolved, configured)
+	}
+}
+
+func Test_WithReadinessService(t *testing.T) {
+	// SETUP
+	var actions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		actions = append(actions, r.Form.Get("Action"))
+		_, _ = w.Write([]byte("<ListQueuesResponse><ListQueuesResult></ListQueuesResult></ListQueuesResponse>"))
+	}))
+	defer server.Close()
+
+	instance := serverInstance(t, server, "sqs")
+	if err := WithReadinessService(ServiceSQS)(instance); err != nil {
+		t.Fatal(err)
+	}
+	instance.resolver = instance.makeResolver()
+
+	// RUN
+	err := instance.Wait(time.Second)
+	_, disabledErr := New(withPool(&fakePool{}), WithServices(ServiceSQS), WithReadinessService(ServiceKinesis))
+	unknownErr := WithReadinessService(ServiceEC2)(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error waiting for sqs: %s", err)
+	}
+
+	if len(actions) != 1 || actions[0] != "ListQueues" {
+		t.Fatalf("expected wait to probe sqs, got %v", actions)
+	}
+
+	if disabledErr == nil {
+		t.Fatal("a readiness service that isn't enabled should be rejected")
+	}
+
+	if unknownErr == nil {
+		t.Fatal("a readiness service without a probe should be rejected")
+	}
+}
+
+func Test_Describe(t *testing.T) {
+	// SETUP
+	instance, err := New(withPool(&fakePool{}), WithServices(ServiceSQS), WithImageTag("3.0.2"), WithRegion("eu-west-1"))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	info := instance.Describe()
+
+	// ASSERT
+	if info.Image != "localstack/localstack" || info.Tag != "3.0.2" {
+		t.Fatalf("expected the image to be described, got %s:%s", info.Image, info.Tag)
+	}
+
+	if info.Region != "eu-west-1" {
+		t.Fatalf("expected the region to be described, got %q", info.Region)
+	}
+
+	if strings.Join(info.Services, ",") != "sqs,s3" {
+		t.Fatalf("expected the services to be described, got %v", info.Services)
+	}
+
+	if info.ContainerID != "fake-1" {
+		t.Fatalf("expected the container id to be described, got %q", info.ContainerID)
+	}
+
+	if info.Ports["sqs"] != "14566" || info.Ports["s3"] != "14566" {
+		t.Fatalf("expected the ports to be described, got %v", info.Ports)
+	}
+}
+
+func Test_WithStopTimeout(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	client := &fakeClient{}
+	logger := &fakeLogger{}
+	instance, err := New(withPool(pool), withClient(client), WithStopTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+	instance.logger = logger
+
+	stuckClient := &fakeClient{ignoresSignals: true}
+	stuck, err := New(withPool(&fakePool{}), withClient(stuckClient), WithStopTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+	stuck.logger = logger
+
+	// RUN
+	closeErr := instance.Close()
+	stuckErr := stuck.Close()
+	invalidErr := WithStopTimeout(0)(&Instance{})
+
+	// ASSERT
+	if closeErr != nil || stuckErr != nil {
+		t.Fatalf("unexpected error closing instances: %v, %v", closeErr, stuckErr)
+	}
+
+	if signal, ok := client.killed["fake-1"]; !ok || signal != docker.SIGTERM {
+		t.Fatalf("expected the container to be sent SIGTERM, got %v", client.killed)
+	}
+
+	if len(client.waited) != 1 || len(pool.purged) != 1 {
+		t.Fatalf("expected the container to be waited on and then purged, got %v waits and %d purges", client.waited, len(pool.purged))
+	}
+
+	if len(logger.messages) != 1 || !strings.Contains(logger.messages[0], "didn't stop within 10ms") {
+		t.Fatalf("expected only the stuck container to be logged, got %v", logger.messages)
+	}
+
+	if invalidErr == nil {
+		t.Fatal("a non-positive stop timeout should be rejected")
+	}
+}
+
+func Test_WithStopTimeoutNotRunning(t *testing.T) {
+	// SETUP
+	client := &fakeClient{killErr: &docker.ContainerNotRunning{ID: "fake-1"}}
+	logger := &fakeLogger{}
+	instance, err := New(withPool(&fakePool{}), withClient(client), WithStopTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+	instance.logger = logger
+
+	// RUN
+	err = instance.Close()
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error closing instance: %s", err)
+	}
+
+	if len(client.waited) != 0 || len(logger.messages) != 0 {
+		t.Fatalf("a container that already stopped shouldn't be waited on or logged, got %v, %v", client.waited, logger.messages)
+	}
+}
+
+func Test_WaitForResource(t *testing.T) {
+	// SETUP
+	instance := &Instance{}
+	withDefaults(instance)
+	_ = noSleep(instance)
+
+	calls := 0
+	bucketExists := func(ctx context.Context) (bool, error) {
+		calls++
+		if calls < 3 {
+			return false, errors.New("NoSuchBucket")
+		}
+
+		return true, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	missing := func(ctx context.Context) (bool, error) {
+		return false, errors.New("NoSuchBucket")
+	}
+
+	// RUN
+	err := instance.WaitForResource(context.Background(), bucketExists)
+	cancelledErr := instance.WaitForResource(ctx, missing)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error waiting for bucket: %s", err)
+	}
+
+	if calls != 3 {
+		t.Fatalf("expected 3 checks before the bucket appeared, got %d", calls)
+	}
+
+	if !errors.Is(cancelledErr, context.Canceled) || !strings.Contains(cancelledErr.Error(), "NoSuchBucket") {
+		t.Fatalf("expected the cancellation and last error, got %v", cancelledErr)
+	}
+}
+
+func Test_WithAutoHost(t *testing.T) {
+	for endpoint, expected := range map[string]string{
+		"tcp://192.168.99.100:2376":   "http://192.168.99.100",
+		"ssh://user@docker.internal":  "http://docker.internal",
+		"unix:///var/run/docker.sock": "http://localhost",
+		"":                            "http://localhost",
+	} {
+		t.Run(endpoint, func(t *testing.T) {
+			// SETUP
+			t.Setenv("DOCKER_HOST", endpoint)
+
+			// RUN
+			instance, err := New(withPool(&fakePool{}), WithAutoHost())
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error creating instance: %s", err)
+			}
+
+			if instance.host != expected {
+				t.Fatalf("expected host %q, got %q", expected, instance.host)
+			}
+		})
+	}
+}
+
+func Test_ResolverMissingPort(t *testing.T) {
+	// SETUP
+	// modern images don't publish the legacy ports
+	resource := fakeResource("unpublished")
+	delete(resource.Container.NetworkSettings.Ports, docker.Port(legacyPorts["sqs"]))
+	instance := &Instance{resource: resource, portMode: PortModeLegacy}
+	withDefaults(instance)
+	resolver := instance.makeResolver()
+
+	// RUN
+	_, err := resolver("sqs", "us-east-1")
+
+	// ASSERT
+	if err == nil {
+		t.Fatal("expected an error for an unpublished port")
+	}
+
+	if !strings.Contains(err.Error(), `"sqs"`) || !strings.Contains(err.Error(), legacyPorts["sqs"]) {
+		t.Fatalf("expected the error to name the service and port, got %s", err)
+	}
+}
+
+func Test_WithReadyStreak(t *testing.T) {
+	// SETUP
+	results := []error{nil, errors.New("flapped"), nil, nil, nil, nil}
+	probes := 0
+	instance := &Instance{
+		healthCheck: func(ctx context.Context, i *Instance) error {
+			probes++
+			return results[probes-1]
+		},
+	}
+	if err := WithReadyStreak(3)(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+	_ = noSleep(instance)
+
+	// RUN
+	err := instance.Wait(time.Minute)
+	invalidErr := WithReadyStreak(0)(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error waiting: %s", err)
+	}
+
+	if probes != 5 {
+		t.Fatalf("expected wait to return after 3 passes in a row, got %d probes", probes)
+	}
+
+	if invalidErr == nil {
+		t.Fatal("a streak below 1 should be rejected")
+	}
+}
+
+func Test_DescribeRedactsCredentials(t *testing.T) {
+	// SETUP
+	instance, err := New(withPool(&fakePool{}), WithCredentials("AKIDEXAMPLE", "hunter2", "token"))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	printed := fmt.Sprintf("%+v %v", instance.Describe(), instance.Describe())
+
+	// ASSERT
+	for _, secret := range []string{"AKIDEXAMPLE", "hunter2", "token"} {
+		if strings.Contains(printed, secret) {
+			t.Fatalf("printed info shouldn't contain %q, got %s", secret, printed)
+		}
+	}
+
+	if !strings.Contains(printed, "REDACTED") {
+		t.Fatalf("expected set credentials to be marked as redacted, got %s", printed)
+	}
+}
+
+func Test_InstanceInfoJSON(t *testing.T) {
+	// SETUP
+	instance, err := New(withPool(&fakePool{}), WithServices(ServiceSQS), WithCredentials("AKIDEXAMPLE", "hunter2", ""))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+	info := instance.Describe()
+
+	// RUN
+	data, err := json.Marshal(info)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error marshaling info: %s", err)
+	}
+
+	var decoded InstanceInfo
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unexpected error unmarshaling info: %s", err)
+	}
+
+	if decoded.Image != info.Image || decoded.Tag != info.Tag || decoded.Region != info.Region ||
+		decoded.ContainerID != info.ContainerID || strings.Join(decoded.Services, ",") != "sqs,s3" ||
+		decoded.Ports["sqs"] != info.Ports["sqs"] {
+		t.Fatalf("expected the public fields to round trip, got %+v from %s", decoded, data)
+	}
+
+	if strings.Contains(string(data), "AKIDEXAMPLE") || strings.Contains(string(data), "hunter2") {
+		t.Fatalf("credentials should be redacted, got %s", data)
+	}
+
+	if decoded.AccessKeyID != "REDACTED" || decoded.SecretAccessKey != "REDACTED" {
+		t.Fatalf("expected set credentials to be marked as redacted, got %s", data)
+	}
+}
+
+func Test_WithCredentialsFromEnv(t *testing.T) {
+	// SETUP
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "hunter2")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	// RUN
+	instance, err := New(withPool(&fakePool{}), WithCredentialsFromEnv())
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	creds, err := instance.Config().Credentials.Retrieve()
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error retrieving credentials: %s", err)
+	}
+
+	if creds.AccessKeyID != "AKIDEXAMPLE" || creds.SecretAccessKey != "hunter2" {
+		t.Fatalf("expected credentials from the environment, got %s/%s", creds.AccessKeyID, creds.SecretAccessKey)
+	}
+
+	if creds.SessionToken != "session" {
+		t.Fatalf("an unset session token should keep its default, got %q", creds.SessionToken)
+	}
+}
+
+func Test_WaitForServicesJoinedErrors(t *testing.T) {
+	// SETUP
+	probeErr := errors.New("connection refused")
+	probes := map[string]func(ctx context.Context, i *Instance) error{
+		"dynamodb": func(ctx context.Context, i *Instance) error {
+			return nil
+		},
+		"sqs": func(ctx context.Context, i *Instance) error {
+			return probeErr
+		},
+	}
+
+	instance := &Instance{probes: probes, services: []string{"dynamodb", "sqs"}}
+	withDefaults(instance)
+	_ = noSleep(instance)
+
+	// RUN
+	err := instance.WaitForServices(0)
+
+	// ASSERT
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		t.Fatalf("expected a joined error, got %v", err)
+	}
+
+	failures := joined.Unwrap()
+	if len(failures) != 1 || failures[0].Error() != "sqs: connection refused" {
+		t.Fatalf("expected only sqs to be reported, got %v", failures)
+	}
+
+	if !errors.Is(err, probeErr) {
+		t.Fatalf("the last probe error should be reachable through the joined error")
+	}
+}
+
+func Test_WithRunOptions(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	tweak := WithRunOptions(func(opts *dockertest.RunOptions) {
+		opts.CapAdd = append(opts.CapAdd, "NET_ADMIN")
+		opts.Env = append(opts.Env, "DEBUG=0")
+	})
+
+	// RUN
+	_, err := New(withPool(pool), tweak, WithDebug())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	opts := pool.runs[0]
+	if !contains(opts.CapAdd, "NET_ADMIN") {
+		t.Fatalf("expected the hook's capabilities, got %v", opts.CapAdd)
+	}
+
+	// the hook runs last even though WithDebug came after it
+	if opts.Env[len(opts.Env)-1] != "DEBUG=0" || !contains(opts.Env, "DEBUG=1") {
+		t.Fatalf("expected the hook to run after other options, got %v", opts.Env)
+	}
+}
+
+func Test_RunOptions(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithServices(ServiceSQS, ServiceSNS), WithEnv("LS_LOG", "info"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if len(pool.runs) != 1 {
+		t.Fatalf("expected a single RunWithOptions call, got %d", len(pool.runs))
+	}
+
+	opts := pool.runs[0]
+	if opts.Repository != "localstack/localstack" || opts.Tag != "" {
+		t.Fatalf("expected the default image, got %s:%s", opts.Repository, opts.Tag)
+	}
+
+	if len(opts.Env) != 2 || opts.Env[0] != "SERVICES=sqs,sns,s3" || opts.Env[1] != "LS_LOG=info" {
+		t.Fatalf("expected the services followed by the custom env, got %v", opts.Env)
+	}
+
+	// docker picks a random name unless one is given
+	if opts.Name != "" {
+		t.Fatalf("expected no container name by default, got %q", opts.Name)
+	}
+}
+
+func Test_WithName(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	conflicted := &fakePool{runErrs: []error{fmt.Errorf("create container: %w", docker.ErrContainerAlreadyExists)}}
+
+	// RUN
+	_, err := New(withPool(pool), WithName("localstack-debug"))
+	_, conflictErr := New(withPool(conflicted), WithName("localstack-debug"))
+	invalidErr := WithName("-nope")(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if pool.runs[0].Name != "localstack-debug" {
+		t.Fatalf("expected the container name to be set, got %q", pool.runs[0].Name)
+	}
+
+	if conflictErr == nil || !strings.Contains(conflictErr.Error(), `named "localstack-debug" already exists`) {
+		t.Fatalf("expected a helpful name conflict error, got %v", conflictErr)
+	}
+
+	if len(conflicted.runs) != 1 {
+		t.Fatalf("name conflicts should not be retried, got %d runs", len(conflicted.runs))
+	}
+
+	if invalidErr == nil {
+		t.Fatal("invalid container names should be rejected")
+	}
+}
+
+func Test_WithProxy(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithProxy("http://proxy:3128", "http://proxy:3129", ""))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	env := pool.runs[0].Env
+	for _, expected := range []string{"HTTP_PROXY=http://proxy:3128", "https_proxy=http://proxy:3129"} {
+		if !contains(env, expected) {
+			t.Fatalf("expected %s in run env, got %v", expected, env)
+		}
+	}
+
+	for _, value := range env {
+		if strings.HasPrefix(strings.ToUpper(value), "NO_PROXY=") {
+			t.Fatalf("an empty no proxy should be skipped, got %v", env)
+		}
+	}
+}
+
+func Test_WithNetwork(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	client := &fakeClient{networks: map[string]*docker.Network{"shared": {ID: "net-shared", Name: "shared"}}}
+
+	created, err := New(withPool(pool), withClient(client), WithNetwork("ci"))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	attached, err := New(withPool(pool), withClient(client), WithNetwork("shared"))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	createdErr := created.Close()
+	attachedErr := attached.Close()
+
+	// ASSERT
+	if createdErr != nil || attachedErr != nil {
+		t.Fatalf("unexpected error closing instances: %v, %v", createdErr, attachedErr)
+	}
+
+	if _, ok := client.connections["net-ci"]; !ok {
+		t.Fatalf("expected the container to join the created network, got %v", client.connections)
+	}
+
+	if _, ok := client.connections["net-shared"]; !ok {
+		t.Fatalf("expected the container to join the existing network, got %v", client.connections)
+	}
+
+	if len(client.createdNetworks) != 1 || client.createdNetworks[0] != "ci" {
+		t.Fatalf("expected only the missing network to be created, got %v", client.createdNetworks)
+	}
+
+	if len(client.removedNetworks) != 1 || client.removedNetworks[0] != "net-ci" {
+		t.Fatalf("expected only the created network to be removed, got %v", client.removedNetworks)
+	}
+}
+
+func Test_WithS3Region(t *testing.T) {
+	for region, constraint := range map[string]string{"eu-west-1": "<LocationConstraint>eu-west-1</LocationConstraint>", "us-east-1": ""} {
+		t.Run(region, func(t *testing.T) {
+			// SETUP
+			var paths, bodies []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				paths = append(paths, r.URL.Path)
+				bodies = append(bodies, string(body))
+			}))
+			defer server.Close()
+
+			instance := serverInstance(t, server, "s3")
+			if err := WithS3Region(region)(instance); err != nil {
+				t.Fatal(err)
+			}
+			instance.resolver = instance.makeResolver()
+
+			// RUN
+			err := instance.CreateBucket(context.TODO(), "regional")
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error creating bucket: %s", err)
+			}
+
+			if len(paths) != 1 || paths[0] != "/regional" {
+				t.Fatalf("expected a single path-style create, got %v", paths)
+			}
+
+			if constraint != "" && !strings.Contains(bodies[0], constraint) {
+				t.Fatalf("expected the location constraint %s, got %q", constraint, bodies[0])
+			}
+
+			if constraint == "" && strings.Contains(bodies[0], "LocationConstraint") {
+				t.Fatalf("us-east-1 buckets must not set a location constraint, got %q", bodies[0])
+			}
+
+			if got := instance.S3Client().Config.Region; got != region {
+				t.Fatalf("expected the s3 client to use %s, got %s", region, got)
+			}
+		})
+	}
+}
+
+func Test_NewPingsDocker(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	client := &fakeClient{pingErr: errors.New("dial unix /var/run/docker.sock: connect: no such file or directory")}
+
+	// RUN
+	_, err := New(withPool(pool), withClient(client))
+
+	// ASSERT
+	if err == nil || !strings.Contains(err.Error(), "docker is not running") {
+		t.Fatalf("expected a friendly docker error, got %v", err)
+	}
+
+	if !errors.Is(err, client.pingErr) {
+		t.Fatalf("the ping error should be wrapped")
+	}
+
+	if len(pool.runs) != 0 {
+		t.Fatalf("no container should be run when docker is unreachable")
+	}
+}
+
+func Test_WithNetworkAlias(t *testing.T) {
+	// SETUP
+	client := &fakeClient{}
+
+	// RUN
+	_, err := New(withPool(&fakePool{}), withClient(client), WithNetwork("ci"), WithNetworkAlias("localstack"))
+	_, missingErr := New(withPool(&fakePool{}), withClient(client), WithNetworkAlias("localstack"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	endpoint := client.connections["net-ci"]
+	if endpoint == nil || len(endpoint.Aliases) != 1 || endpoint.Aliases[0] != "localstack" {
+		t.Fatalf("expected the alias on the network endpoint, got %+v", endpoint)
+	}
+
+	if missingErr == nil {
+		t.Fatal("aliases without a network should be rejected")
+	}
+}
+
+func Test_WaitHungProbe(t *testing.T) {
+	// SETUP
+	instance := &Instance{
+		healthCheck: func(ctx context.Context, i *Instance) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	withDefaults(instance)
+
+	// RUN
+	start := time.Now()
+	err := instance.Wait(100 * time.Millisecond)
+	elapsed := time.Since(start)
+
+	// ASSERT
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the hung probe to hit the deadline, got %v", err)
+	}
+
+	if elapsed > time.Second {
+		t.Fatalf("wait should return by its deadline, took %s", elapsed)
+	}
+}
+
+func Test_WithAllServices(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	logger := &fakeLogger{}
+
+	// RUN
+	_, err := New(withPool(pool), WithAllServices(), WithLogger(logger))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	env := pool.runs[0].Env[0]
+	enabled := strings.Split(strings.TrimPrefix(env, "SERVICES="), ",")
+	if len(enabled) != len(legacyPorts) {
+		t.Fatalf("expected all %d services to be enabled, got %s", len(legacyPorts), env)
+	}
+
+	for service := range legacyPorts {
+		if !contains(enabled, service) {
+			t.Fatalf("expected %s to be enabled, got %s", service, env)
+		}
+	}
+
+	if len(logger.messages) == 0 || !strings.Contains(logger.messages[0], "all") {
+		t.Fatalf("expected a warning about enabling every service, got %v", logger.messages)
+	}
+}
+
+func Test_DynamoStreamsClient(t *testing.T) {
+	// SETUP
+	var targets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets = append(targets, r.Header.Get("X-Amz-Target"))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = w.Write([]byte(`{"StreamDescription":{"StreamArn":"arn:aws:dynamodb:us-east-1:000000000000:table/orders/stream/1","StreamStatus":"ENABLED"}}`))
+	}))
+	defer server.Close()
+
+	instance := serverInstance(t, server, "dynamodb", "streams.dynamodb")
+	instance.resolver = instance.makeResolver()
+	arn := "arn:aws:dynamodb:us-east-1:000000000000:table/orders/stream/1"
+
+	// RUN
+	res, err := instance.DynamoStreamsClient().DescribeStreamRequest(&dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(arn)}).Send(context.TODO())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error describing stream: %s", err)
+	}
+
+	if len(targets) != 1 || targets[0] != "DynamoDBStreams_20120810.DescribeStream" {
+		t.Fatalf("expected the stream to be described through the edge port, got %v", targets)
+	}
+
+	if aws.StringValue(res.StreamDescription.StreamArn) != arn {
+		t.Fatalf("expected the stream description, got %+v", res.StreamDescription)
+	}
+}
+
+func Test_WaitHealthy(t *testing.T) {
+	// SETUP
+	client := &fakeClient{exited: map[string]int{"fake-1": 3}, logs: "ERROR: failed to bind port 4566\n"}
+	notReady := WithHealthCheck(func(ctx context.Context, i *Instance) error {
+		return errors.New("connection refused")
+	})
+	crashed, err := New(withPool(&fakePool{}), withClient(client), notReady, noSleep)
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	running, err := New(withPool(&fakePool{}), withClient(&fakeClient{}), noSleep, WithHealthCheck(func(ctx context.Context, i *Instance) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// RUN
+	crashedErr := crashed.WaitHealthy(ctx)
+	runningErr := running.WaitHealthy(ctx)
+
+	// ASSERT
+	if crashedErr == nil || !strings.Contains(crashedErr.Error(), "exited with code 3") {
+		t.Fatalf("expected the exit code to be reported, got %v", crashedErr)
+	}
+
+	if !strings.Contains(crashedErr.Error(), "failed to bind port 4566") {
+		t.Fatalf("expected the container logs to be included, got %v", crashedErr)
+	}
+
+	if runningErr != nil {
+		t.Fatalf("unexpected error waiting for a healthy instance: %s", runningErr)
+	}
+}
+
+func Test_SQSClientQueueURLs(t *testing.T) {
+	// SETUP
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		switch r.Form.Get("Action") {
+		case "CreateQueue":
+			// localstack reports the port it listens on inside the container
+			_, _ = w.Write([]byte("<CreateQueueResponse><CreateQueueResult><QueueUrl>http://localhost:4566/000000000000/orders</QueueUrl></CreateQueueResult></CreateQueueResponse>"))
+		case "SendMessage":
+			sent = append(sent, r.Form.Get("QueueUrl"))
+			_, _ = w.Write([]byte("<SendMessageResponse><SendMessageResult><MessageId>1</MessageId><MD5OfMessageBody>5d41402abc4b2a76b9719d911017c592</MD5OfMessageBody></SendMessageResult></SendMessageResponse>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	instance := serverInstance(t, server, "sqs")
+	instance.resolver = instance.makeResolver()
+	client := instance.SQSClient()
+
+	// RUN
+	created, err := client.CreateQueueRequest(&sqs.CreateQueueInput{QueueName: aws.String("orders")}).Send(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error creating queue: %s", err)
+	}
+
+	_, sendErr := client.SendMessageRequest(&sqs.SendMessageInput{QueueUrl: created.QueueUrl, MessageBody: aws.String("hello")}).Send(context.TODO())
+
+	// ASSERT
+	expected := server.URL + "/000000000000/orders"
+	if aws.StringValue(created.QueueUrl) != expected {
+		t.Fatalf("expected the queue url to point at the instance, got %s", aws.StringValue(created.QueueUrl))
+	}
+
+	if sendErr != nil {
+		t.Fatalf("unexpected error sending message: %s", sendErr)
+	}
+
+	if len(sent) != 1 || sent[0] != expected {
+		t.Fatalf("expected the message to be sent to the rewritten queue url, got %v", sent)
+	}
+}
+
+func Test_WithSeed(t *testing.T) {
+	// SETUP
+	tables := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct{ TableName string }
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.CreateTable":
+			tables[input.TableName] = true
+			fmt.Fprintf(w, `{"TableDescription":{"TableName":%q}}`, input.TableName)
+		case "DynamoDB_20120810.DescribeTable":
+			if !tables[input.TableName] {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ResourceNotFoundException","message":"not found"}`))
+				return
+			}
+
+			fmt.Fprintf(w, `{"Table":{"TableName":%q,"TableStatus":"ACTIVE"}}`, input.TableName)
+		}
+	}))
+	defer server.Close()
+
+	instance := serverInstance(t, server, "dynamodb")
+	instance.resolver = instance.makeResolver()
+	instance.healthCheck = func(ctx context.Context, i *Instance) error {
+		return nil
+	}
+
+	seed := WithSeed(func(ctx context.Context, cfg aws.Config) error {
+		_, err := dynamodb.New(cfg).CreateTableRequest(&dynamodb.CreateTableInput{
+			TableName:            aws.String("orders"),
+			AttributeDefinitions: []dynamodb.AttributeDefinition{{AttributeName: aws.String("id"), AttributeType: dynamodb.ScalarAttributeTypeS}},
+			KeySchema:            []dynamodb.KeySchemaElement{{AttributeName: aws.String("id"), KeyType: dynamodb.KeyTypeHash}},
+			BillingMode:          dynamodb.BillingModePayPerRequest,
+		}).Send(ctx)
+		return err
+	})
+	if err := seed(instance); err != nil {
+		t.Fatal(err)
+	}
+
+	// RUN
+	err := instance.Wait(time.Second)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error waiting: %s", err)
+	}
+
+	table, err := dynamodb.New(instance.Config()).DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String("orders")}).Send(context.TODO())
+	if err != nil {
+		t.Fatalf("expected the seeded table to exist, got %s", err)
+	}
+
+	if aws.StringValue(table.Table.TableName) != "orders" {
+		t.Fatalf("expected the orders table, got %+v", table.Table)
+	}
+}
+
+func Test_WithSeedError(t *testing.T) {
+	// SETUP
+	seedErr := errors.New("bucket already exists")
+	instance := &Instance{healthCheck: func(ctx context.Context, i *Instance) error { return nil }}
+	if err := WithSeed(func(ctx context.Context, cfg aws.Config) error { return seedErr })(instance); err != nil {
+		t.Fatal(err)
+	}
+	withDefaults(instance)
+	instance.resolver = instance.makeResolver()
+
+	// RUN
+	err := instance.Wait(time.Second)
+
+	// ASSERT
+	if !errors.Is(err, seedErr) {
+		t.Fatalf("expected the seed error to fail wait, got %v", err)
+	}
+}
+
+func Test_WithSnapshot(t *testing.T) {
+	// SETUP
+	dir := t.TempDir()
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithProToken("token"), WithSnapshot(dir))
+	_, communityErr := New(withPool(&fakePool{}), WithSnapshot(dir))
+	missingErr := WithSnapshot(filepath.Join(dir, "missing"))(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	opts := pool.runs[0]
+	if !contains(opts.Mounts, dir+":/var/lib/localstack/state") {
+		t.Fatalf("expected the snapshot to be mounted, got %v", opts.Mounts)
+	}
+
+	for _, expected := range []string{"PERSISTENCE=1", "SNAPSHOT_LOAD_STRATEGY=ON_STARTUP", "SNAPSHOT_SAVE_STRATEGY=MANUAL"} {
+		if !contains(opts.Env, expected) {
+			t.Fatalf("expected %s in run env, got %v", expected, opts.Env)
+		}
+	}
+
+	if communityErr == nil || !strings.Contains(communityErr.Error(), "WithProToken") {
+		t.Fatalf("expected snapshots to require pro, got %v", communityErr)
+	}
+
+	if missingErr == nil {
+		t.Fatal("a missing snapshot directory should be rejected")
+	}
+}
+
+func Test_WaitForLog(t *testing.T) {
+	// SETUP
+	client := &fakeClient{logs: "Starting edge router\nRea"}
+	instance, err := New(withPool(&fakePool{}), withClient(client))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// RUN
+	missingErr := instance.WaitForLog(ctx, "Ready.")
+	client.logs = "Starting edge router\nReady.\n"
+	readyErr := instance.WaitForLog(context.Background(), "Ready.")
+
+	// ASSERT
+	if !errors.Is(missingErr, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to end the wait, got %v", missingErr)
+	}
+
+	if readyErr != nil {
+		t.Fatalf("expected the ready line to be found, got %s", readyErr)
+	}
+}
+
+func Test_logMatcherSplitWrites(t *testing.T) {
+	// SETUP
+	found := false
+	match := &logMatcher{substring: []byte("Ready."), found: func() { found = true }}
+
+	// RUN
+	for _, chunk := range []string{"Starting...\nRe", "a", "dy.\n"} {
+		_, _ = match.Write([]byte(chunk))
+	}
+
+	// ASSERT
+	if !found || !match.matched() {
+		t.Fatal("expected a line split across writes to match")
+	}
+}
+
+func Test_WithReadyLog(t *testing.T) {
+	// SETUP
+	probed := false
+	check := WithHealthCheck(func(ctx context.Context, i *Instance) error {
+		probed = true
+		return nil
+	})
+	ready, err := New(withPool(&fakePool{}), withClient(&fakeClient{logs: "Ready.\n"}), WithReadyLog("Ready."), check, noSleep)
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	silent, err := New(withPool(&fakePool{}), withClient(&fakeClient{}), WithReadyLog("Ready."), check, noSleep)
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	readyErr := ready.Wait(time.Minute)
+	silentErr := silent.Wait(50 * time.Millisecond)
+	emptyErr := WithReadyLog("")(&Instance{})
+
+	// ASSERT
+	if readyErr != nil || !probed {
+		t.Fatalf("expected the probe to run once the ready line was logged, got %v", readyErr)
+	}
+
+	var timeout *TimeoutError
+	if !errors.As(silentErr, &timeout) {
+		t.Fatalf("expected a timeout waiting for the ready line, got %v", silentErr)
+	}
+
+	if emptyErr == nil {
+		t.Fatal("an empty ready line should be rejected")
+	}
+}
+
+func Test_WithPortOverrides(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	instance, err := New(withPool(pool), WithServices(ServiceS3, ServiceSQS), WithPortOverrides(map[Service]string{"S3": "4590"}))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	s3Endpoint, s3Err := instance.Endpoint(ServiceS3)
+	sqsEndpoint, sqsErr := instance.Endpoint("sqs")
+	invalidErr := WithPortOverrides(map[Service]string{"s3": "edge"})(&Instance{})
+
+	// ASSERT
+	if s3Err != nil || sqsErr != nil {
+		t.Fatalf("unexpected error resolving endpoints: %v, %v", s3Err, sqsErr)
+	}
+
+	if !strings.HasSuffix(s3Endpoint, ":14590") {
+		t.Fatalf("expected s3 to resolve to the host port published for 4590, got %s", s3Endpoint)
+	}
+
+	if !strings.HasSuffix(sqsEndpoint, ":14566") {
+		t.Fatalf("expected sqs to keep using the edge port, got %s", sqsEndpoint)
+	}
+
+	if !contains(pool.runs[0].ExposedPorts, "4590/tcp") {
+		t.Fatalf("expected the overridden port to be exposed, got %v", pool.runs[0].ExposedPorts)
+	}
+
+	if invalidErr == nil {
+		t.Fatal("a non-numeric port should be rejected")
+	}
+}
+
+func Test_Exec(t *testing.T) {
+	// SETUP
+	client := &fakeClient{execOut: "make_bucket: x\n"}
+	instance, err := New(withPool(&fakePool{}), withClient(client))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	stdout, _, execErr := instance.Exec(context.Background(), "awslocal", "s3", "mb", "s3://x")
+	client.execExit = 1
+	_, _, failedErr := instance.Exec(context.Background(), "awslocal", "s3", "mb", "s3://x")
+	_, _, emptyErr := instance.Exec(context.Background())
+
+	// ASSERT
+	if execErr != nil {
+		t.Fatalf("unexpected error running exec: %s", execErr)
+	}
+
+	if stdout != "make_bucket: x\n" {
+		t.Fatalf("expected the command's stdout, got %q", stdout)
+	}
+
+	if strings.Join(client.execs[0], " ") != "awslocal s3 mb s3://x" {
+		t.Fatalf("expected the command to be run as given, got %v", client.execs[0])
+	}
+
+	if failedErr == nil || !strings.Contains(failedErr.Error(), "exited with code 1") {
+		t.Fatalf("expected a non-zero exit to fail, got %v", failedErr)
+	}
+
+	if emptyErr == nil {
+		t.Fatal("an empty command should be rejected")
+	}
+}
+
+func Test_WithPreStart(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	ranBeforeRun := false
+	hook := WithPreStart(func() error {
+		ranBeforeRun = len(pool.runs) == 0
+		return nil
+	})
+	failing := WithPreStart(func() error {
+		return errors.New("no space left on device")
+	})
+	failingPool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), hook)
+	_, failedErr := New(withPool(failingPool), failing)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if !ranBeforeRun {
+		t.Fatal("expected the pre-start hook to run before the container was created")
+	}
+
+	if failedErr == nil || !strings.Contains(failedErr.Error(), "no space left on device") {
+		t.Fatalf("expected the hook's error to abort New, got %v", failedErr)
+	}
+
+	if len(failingPool.runs) != 0 {
+		t.Fatalf("expected no container to be started after a failed hook, got %d", len(failingPool.runs))
+	}
+}
+
+func Test_CopyTo(t *testing.T) {
+	// SETUP
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "fixtures", "nested"), 0755); err != nil {
+		t.Fatalf("unexpected error creating fixtures: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "fixtures", "nested", "data.json"), []byte(`{"ok":true}`), 0644); err != nil {
+		t.Fatalf("unexpected error writing fixture: %s", err)
+	}
+
+	client := &fakeClient{}
+	instance, err := New(withPool(&fakePool{}), withClient(client))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	err = instance.CopyTo(context.Background(), filepath.Join(dir, "fixtures"), "/opt/code/seed")
+	missingErr := instance.CopyTo(context.Background(), filepath.Join(dir, "missing"), "/opt/code/missing")
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error copying fixtures: %s", err)
+	}
+
+	if content := client.uploads["/opt/code/seed/nested/data.json"]; content != `{"ok":true}` {
+		t.Fatalf("expected the fixture to be copied under the destination, got %v", client.uploads)
+	}
+
+	if missingErr == nil {
+		t.Fatal("copying a missing file should fail")
+	}
+}
+
+func Test_WithEnvFile(t *testing.T) {
+	// SETUP
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "localstack.env")
+	content := "# shared localstack config\n\nDEBUG=1\nexport LAMBDA_EXECUTOR=\"docker-reuse\"\nSERVICES=kinesis\nGREETING='hello world'\n"
+	if err := ioutil.WriteFile(envFile, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error writing env file: %s", err)
+	}
+
+	malformed := filepath.Join(dir, "malformed.env")
+	if err := ioutil.WriteFile(malformed, []byte("DEBUG=1\nnot a variable\n"), 0644); err != nil {
+		t.Fatalf("unexpected error writing env file: %s", err)
+	}
+
+	pool := &fakePool{}
+
+	// RUN
+	_, err := New(withPool(pool), WithServices(ServiceSQS), WithEnvFile(envFile))
+	malformedErr := WithEnvFile(malformed)(&Instance{})
+	missingErr := WithEnvFile(filepath.Join(dir, "missing.env"))(&Instance{})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	env := pool.runs[0].Env
+	for _, expected := range []string{"DEBUG=1", "LAMBDA_EXECUTOR=docker-reuse", "GREETING=hello world"} {
+		if !contains(env, expected) {
+			t.Fatalf("expected %s in run env, got %v", expected, env)
+		}
+	}
+
+	if contains(env, "SERVICES=kinesis") || !contains(env, "SERVICES=sqs,s3") {
+		t.Fatalf("expected the generated SERVICES to win over the env file, got %v", env)
+	}
+
+	if malformedErr == nil || !strings.Contains(malformedErr.Error(), "malformed.env:2") {
+		t.Fatalf("expected the malformed line to be reported, got %v", malformedErr)
+	}
+
+	if missingErr == nil {
+		t.Fatal("a missing env file should be rejected")
+	}
+}
+
+func Test_WithS3VirtualHost(t *testing.T) {
+	// SETUP
+	instance, err := New(withPool(&fakePool{}), WithServices(ServiceS3, ServiceSQS), WithS3VirtualHost())
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	client := instance.S3Client()
+	s3Endpoint, s3Err := instance.Endpoint(ServiceS3)
+	sqsEndpoint, sqsErr := instance.Endpoint("sqs")
+
+	// ASSERT
+	if s3Err != nil || sqsErr != nil {
+		t.Fatalf("unexpected error resolving endpoints: %v, %v", s3Err, sqsErr)
+	}
+
+	if client.ForcePathStyle {
+		t.Fatal("expected the S3 client to use virtual-hosted-style addressing")
+	}
+
+	if s3Endpoint != "http://s3.localhost.localstack.cloud:14566" {
+		t.Fatalf("expected s3 to resolve to the virtual host domain, got %s", s3Endpoint)
+	}
+
+	if sqsEndpoint != "http://localhost:14566" {
+		t.Fatalf("expected other services to keep the instance host, got %s", sqsEndpoint)
+	}
+}
+
+func Test_WithTimings(t *testing.T) {
+	// SETUP
+	now := time.Now()
+	tick := func(i *Instance) error {
+		// every reading of the clock moves it forward, so each phase takes some time
+		i.now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		i.sleep = func(d time.Duration) {}
+		return nil
+	}
+
+	var reports []Timings
+	timings := WithTimings(func(t Timings) {
+		reports = append(reports, t)
+	})
+	ready := WithHealthCheck(func(ctx context.Context, i *Instance) error {
+		return nil
+	})
+
+	// RUN
+	instance, err := New(withPool(&fakePool{}), tick, timings, ready)
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	waitErr := instance.Wait(time.Minute)
+
+	// ASSERT
+	if waitErr != nil {
+		t.Fatalf("unexpected error waiting: %s", waitErr)
+	}
+
+	if len(reports) != 2 {
+		t.Fatalf("expected timings from New and Wait, got %v", reports)
+	}
+
+	if reports[0].Start <= 0 || reports[0].Wait != 0 {
+		t.Fatalf("expected New to report only the start, got %+v", reports[0])
+	}
+
+	if reports[1].Start != reports[0].Start || reports[1].Wait <= 0 {
+		t.Fatalf("expected Wait to add its duration, got %+v", reports[1])
+	}
+}
+
+func Test_WithTimingsPull(t *testing.T) {
+	// SETUP
+	now := time.Now()
+	tick := func(i *Instance) error {
+		i.now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		return nil
+	}
+
+	var reports []Timings
+	timings := WithTimings(func(t Timings) {
+		reports = append(reports, t)
+	})
+	client := &fakeClient{}
+
+	// RUN
+	_, missErr := New(withPool(&fakePool{}), withClient(client), tick, timings)
+	_, cachedErr := New(withPool(&fakePool{}), withClient(client), tick, timings)
+
+	// ASSERT
+	if missErr != nil || cachedErr != nil {
+		t.Fatalf("unexpected error creating instances: %v, %v", missErr, cachedErr)
+	}
+
+	if len(client.pulls) != 1 {
+		t.Fatalf("expected only the first instance to pull the image, got %+v", client.pulls)
+	}
+
+	if len(reports) != 2 {
+		t.Fatalf("expected timings from both instances, got %v", reports)
+	}
+
+	if reports[0].Pull <= 0 || reports[0].Start <= 0 {
+		t.Fatalf("expected the first instance to report the pull and the start, got %+v", reports[0])
+	}
+
+	if reports[1].Pull != 0 || reports[1].Start <= 0 {
+		t.Fatalf("expected the cached image to take no time to pull, got %+v", reports[1])
+	}
+}
+
+func Test_NewPullError(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	client := &fakeClient{pullErr: errors.New("registry unavailable")}
+
+	// RUN
+	_, err := New(withPool(pool), withClient(client), WithImageTag("3.0"), WithPlatform("linux/arm64"))
+
+	// ASSERT
+	if err == nil || !strings.Contains(err.Error(), "registry unavailable") {
+		t.Fatalf("expected the pull error, got %v", err)
+	}
+
+	if len(client.pulls) != 1 || client.pulls[0].Tag != "3.0" || client.pulls[0].Platform != "linux/arm64" {
+		t.Fatalf("expected a pull of tag 3.0 for linux/arm64, got %+v", client.pulls)
+	}
+
+	if len(pool.runs) != 0 {
+		t.Fatalf("expected no container to be run after the pull failed, got %d", len(pool.runs))
+	}
+}
+
+func Test_WithPlatformCachedImage(t *testing.T) {
+	// SETUP
+	cached := map[string]*docker.Image{
+		image + ":2.0": {OS: "linux", Architecture: "amd64"},
+		image + ":3.0": {OS: "linux", Architecture: "arm64"},
+		image + ":4.0": {},
+	}
+
+	cases := map[string]struct {
+		tag    string
+		pulled bool
+	}{
+		"other platform":   {"2.0", true},
+		"same platform":    {"3.0", false},
+		"unknown platform": {"4.0", false},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			client := &fakeClient{images: make(map[string]*docker.Image)}
+			for ref, cachedImage := range cached {
+				client.images[ref] = cachedImage
+			}
+
+			// RUN
+			_, err := New(withPool(&fakePool{}), withClient(client), WithImageTag(c.tag), WithPlatform("linux/arm64"))
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error creating instance: %s", err)
+			}
+
+			if !c.pulled {
+				if len(client.pulls) != 0 {
+					t.Fatalf("expected the cached image to be used, got pulls %+v", client.pulls)
+				}
+				return
+			}
+
+			if len(client.pulls) != 1 || client.pulls[0].Platform != "linux/arm64" {
+				t.Fatalf("expected the image to be pulled for linux/arm64, got %+v", client.pulls)
+			}
+
+			if pulled := client.images[image+":"+c.tag]; pulled.Architecture != "arm64" {
+				t.Fatalf("expected the tag to point at the arm64 image, got %+v", pulled)
+			}
+		})
+	}
+}
+
+func Test_WithTimingsStartupTimeout(t *testing.T) {
+	// SETUP
+	var reports []Timings
+	timings := WithTimings(func(t Timings) {
+		reports = append(reports, t)
+	})
+	ready := WithHealthCheck(func(ctx context.Context, i *Instance) error {
+		return nil
+	})
+
+	// RUN
+	_, err := New(withPool(&fakePool{}), timings, ready, WithStartupTimeout(time.Minute))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if len(reports) != 1 {
+		t.Fatalf("expected the startup wait to be reported once, got %v", reports)
+	}
+}
+
+func Test_detectPortMode(t *testing.T) {
+	cases := []struct {
+		name      string
+		published []string
+		expected  PortMode
+		sqsPort   string
+	}{
+		{"edge only", []string{"4566/tcp"}, PortModeEdge, "14566"},
+		{"legacy only", []string{"4572/tcp", "4576/tcp"}, PortModeLegacy, "14576"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// SETUP
+			logger := &fakeLogger{}
+			pool := &fakePool{published: c.published}
+
+			// RUN
+			instance, err := New(withPool(pool), WithServices(ServiceSQS), WithLogger(logger))
+			if err != nil {
+				t.Fatalf("unexpected error creating instance: %s", err)
+			}
+
+			endpoint, endpointErr := instance.Endpoint("sqs")
+
+			// ASSERT
+			if instance.portMode != c.expected {
+				t.Fatalf("expected port mode %d, got %d", c.expected, instance.portMode)
+			}
+
+			if endpointErr != nil || !strings.HasSuffix(endpoint, ":"+c.sqsPort) {
+				t.Fatalf("expected sqs on host port %s, got %s (%v)", c.sqsPort, endpoint, endpointErr)
+			}
+		})
+	}
+}
+
+func Test_detectPortModeExplicit(t *testing.T) {
+	// SETUP
+	pool := &fakePool{published: []string{"4572/tcp"}}
+
+	// RUN
+	instance, err := New(withPool(pool), WithPortMode(PortModeEdge))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	if instance.portMode != PortModeEdge {
+		t.Fatal("an explicit port mode shouldn't be overridden")
+	}
+}
+
+func Test_WithShutdownHook(t *testing.T) {
+	// SETUP
+	pool := &fakePool{}
+	var calls []string
+	first := WithShutdownHook(func(ctx context.Context, i *Instance) error {
+		calls = append(calls, fmt.Sprintf("first, %d purged", len(pool.purged)))
+		return errors.New("export failed")
+	})
+	second := WithShutdownHook(func(ctx context.Context, i *Instance) error {
+		calls = append(calls, "second")
+		return nil
+	})
+
+	instance, err := New(withPool(pool), first, second)
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	closeErr := instance.Close()
+
+	// ASSERT
+	if closeErr == nil || !strings.Contains(closeErr.Error(), "export failed") {
+		t.Fatalf("expected the hook error from Close, got %v", closeErr)
+	}
+
+	if strings.Join(calls, "; ") != "first, 0 purged; second" {
+		t.Fatalf("expected every hook to run before the purge, got %v", calls)
+	}
+
+	if len(pool.purged) != 1 {
+		t.Fatalf("expected the container to be purged despite the hook error, got %d purges", len(pool.purged))
+	}
+}
+
+func Test_WaitForStream(t *testing.T) {
+	// SETUP
+	statuses := []string{"CREATING", "CREATING", "ACTIVE"}
+	var targets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets = append(targets, r.Header.Get("X-Amz-Target"))
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		_, _ = fmt.Fprintf(w, `{"StreamDescriptionSummary":{"StreamName":"events","StreamStatus":%q}}`, status)
+	}))
+	defer server.Close()
+
+	instance := serverInstance(t, server, "kinesis")
+	instance.resolver = instance.makeResolver()
+	instance.sleep = func(d time.Duration) {}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// RUN
+	err := instance.WaitForStream(ctx, "events")
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error waiting for stream: %s", err)
+	}
+
+	if len(targets) != 3 || targets[0] != "Kinesis_20131202.DescribeStreamSummary" {
+		t.Fatalf("expected the stream to be described until it was active, got %v", targets)
+	}
+}
+
+func Test_nativePlatform(t *testing.T) {
+	arch := func(goarch string) InstanceOpt {
+		return func(i *Instance) error {
+			i.arch = goarch
+			return nil
+		}
+	}
+
+	cases := []struct {
+		name     string
+		opts     []InstanceOpt
+		expected string
+	}{
+		{"arm64", []InstanceOpt{arch("arm64")}, "linux/arm64"},
+		{"amd64", []InstanceOpt{arch("amd64")}, ""},
+		{"explicit tag", []InstanceOpt{arch("arm64"), WithImageTag("0.10.7")}, ""},
+		{"explicit platform", []InstanceOpt{arch("arm64"), WithPlatform("linux/amd64")}, "linux/amd64"},
+		{"pro image", []InstanceOpt{arch("arm64"), WithProToken("token")}, "linux/arm64"},
+		{"mirror", []InstanceOpt{arch("arm64"), WithImage("registry.example.com/localstack")}, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// SETUP
+			pool := &fakePool{}
+
+			// RUN
+			_, err := New(append([]InstanceOpt{withPool(pool)}, c.opts...)...)
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error creating instance: %s", err)
+			}
+
+			if pool.runs[0].Platform != c.expected {
+				t.Fatalf("expected platform %q, got %q", c.expected, pool.runs[0].Platform)
+			}
+		})
+	}
+}
+
+func Test_NewExternalContainerOptions(t *testing.T) {
+	// SETUP
+	dir := t.TempDir()
+	rejected := map[string]InstanceOpt{
+		"fixed port":        WithFixedPort(4566, 4566),
+		"legacy ports":      WithPortMode(PortModeLegacy),
+		"host network":      WithHostNetwork(),
+		"network":           WithNetwork("localstack"),
+		"env":               WithEnv("DEBUG", "1"),
+		"pro token":         WithProToken("token"),
+		"image":             WithImage("registry.example.com/localstack"),
+		"image tag":         WithImageTag("3.0.2"),
+		"name":              WithName("localstack"),
+		"data dir":          WithDataDir(dir),
+		"init scripts":      WithInitScripts(dir),
+		"snapshot":          WithSnapshot(dir),
+		"labels":            WithLabels(map[string]string{"project": "foo"}),
+		"memory":            WithMemory(512 * 1024 * 1024),
+		"cpu shares":        WithCPUShares(512),
+		"cmd":               WithCmd("localstack", "start"),
+		"clean volumes":     WithCleanVolumes(),
+		"stop timeout":      WithStopTimeout(time.Second),
+		"run options":       WithRunOptions(func(opts *dockertest.RunOptions) {}),
+		"pre-start":         WithPreStart(func() error { return nil }),
+		"platform":          WithPlatform("linux/amd64"),
+		"ready log":         WithReadyLog("Ready."),
+		"registry auth":     WithRegistryAuth("user", "password", "registry.example.com"),
+		"init timeout":      WithInitTimeout(time.Minute),
+		"extra hosts":       WithExtraHosts("db:10.0.0.2"),
+		"platform fallback": WithPlatformFallback(),
+	}
+
+	// RUN
+	overridden, err := NewExternal("localhost", WithPortOverrides(map[Service]string{"s3": "4572"}))
+	if err != nil {
+		t.Fatalf("unexpected error creating external instance: %s", err)
+	}
+
+	_, endpointErr := overridden.Endpoint("s3")
+
+	// ASSERT
+	if endpointErr == nil || !strings.Contains(endpointErr.Error(), "no host port is published") {
+		t.Fatalf("expected an unpublished override to fail to resolve, got %v", endpointErr)
+	}
+
+	for name, opt := range rejected {
+		if _, err := NewExternal("localhost", opt); err == nil || !strings.Contains(err.Error(), "NewExternal") {
+			t.Fatalf("expected %s to be rejected by NewExternal, got %v", name, err)
+		}
+	}
+
+	if _, err := NewExternal("localhost", WithSSL(), WithServices(ServiceSQS), WithRegion("eu-west-1")); err != nil {
+		t.Fatalf("options that don't touch the container should be accepted, got %s", err)
+	}
+}
+
+func Test_WithPortOverridesUnknownService(t *testing.T) {
+	// SETUP
+	overrides := WithPortOverrides(map[Service]string{"stepfunctions": "4585"})
+
+	// RUN
+	before, beforeErr := New(withPool(&fakePool{}), overrides, WithServices("stepfunctions"))
+	after, afterErr := New(withPool(&fakePool{}), WithServices("stepfunctions"), overrides)
+
+	// ASSERT
+	if beforeErr != nil || afterErr != nil {
+		t.Fatalf("expected a service with an override to be accepted in any order, got %v, %v", beforeErr, afterErr)
+	}
+
+	for _, instance := range []*Instance{before, after} {
+		if endpoint, err := instance.Endpoint("stepfunctions"); err != nil || !strings.HasSuffix(endpoint, ":14585") {
+			t.Fatalf("expected stepfunctions on its overridden port, got %s (%v)", endpoint, err)
+		}
+	}
+}
+
+func Test_ResolverSDKEndpointIDs(t *testing.T) {
+	// SETUP
+	instance, err := New(withPool(&fakePool{}), WithServices(ServiceCloudWatch, ServiceSES), WithStrictResolver(), WithPortMode(PortModeLegacy))
+	if err != nil {
+		t.Fatalf("unexpected error creating instance: %s", err)
+	}
+
+	// RUN
+	monitoring, monitoringErr := instance.resolver("monitoring", "us-east-1")
+	email, emailErr := instance.resolver("email", "us-east-1")
+
+	// ASSERT
+	if monitoringErr != nil || !strings.HasSuffix(monitoring.URL, ":14582") {
+		t.Fatalf("expected monitoring to resolve to localstack's cloudwatch, got %s (%v)", monitoring.URL, monitoringErr)
+	}
+
+	if emailErr != nil || !strings.HasSuffix(email.URL, ":14579") {
+		t.Fatalf("expected email to resolve to localstack's ses, got %s (%v)", email.URL, emailErr)
+	}
+}
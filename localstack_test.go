@@ -3,12 +3,18 @@ package localstack_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/eriktate/go-localstack"
@@ -160,3 +166,533 @@ func Test_SQS(t *testing.T) {
 	// CLEANUP
 	_ = instance.Close()
 }
+
+func Test_HostnameExternal(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+	instance, err := localstack.New(
+		localstack.WithServices("sqs"),
+		localstack.WithHostnameExternal("localstack.test"),
+		// path based queue urls are the ones built from HOSTNAME_EXTERNAL
+		localstack.WithEnv("SQS_ENDPOINT_STRATEGY", "off"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.Wait(20 * time.Second); err != nil {
+		_ = instance.Close()
+		t.Fatal(err)
+	}
+
+	// RUN
+	res, err := sqs.New(instance.Config()).CreateQueueRequest(&sqs.CreateQueueInput{QueueName: aws.String("external")}).Send(ctx)
+	if err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error creating sqs queue: %s", err)
+	}
+
+	// ASSERT
+	if queueURL := aws.StringValue(res.QueueUrl); !strings.Contains(queueURL, "://localstack.test:") {
+		_ = instance.Close()
+		t.Fatalf("expected the queue url to use the external hostname, got %s", queueURL)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_Ready(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+
+	instance, err := localstack.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RUN
+	readyBeforeWait := instance.Ready(ctx)
+
+	if err := instance.Wait(20 * time.Second); err != nil {
+		_ = instance.Close()
+		t.Fatal(err)
+	}
+
+	readyAfterWait := instance.Ready(ctx)
+
+	// ASSERT
+	if readyBeforeWait {
+		_ = instance.Close()
+		t.Fatalf("instance should not be ready immediately after starting")
+	}
+
+	if !readyAfterWait {
+		_ = instance.Close()
+		t.Fatalf("instance should be ready after Wait succeeds")
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_Parallel(t *testing.T) {
+	// SETUP
+	const count = 4
+	instances := make(chan *localstack.Instance, count)
+	errs := make(chan error, count)
+
+	// RUN
+	for idx := 0; idx < count; idx++ {
+		go func() {
+			instance, err := localstack.New()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if err := instance.Wait(30 * time.Second); err != nil {
+				_ = instance.Close()
+				errs <- err
+				return
+			}
+
+			instances <- instance
+		}()
+	}
+
+	endpoints := map[string]bool{}
+	var started []*localstack.Instance
+	var failure error
+	for idx := 0; idx < count; idx++ {
+		select {
+		case instance := <-instances:
+			started = append(started, instance)
+			endpoint, err := instance.Config().EndpointResolver.ResolveEndpoint("s3", "us-east-1")
+			if err != nil {
+				failure = err
+				continue
+			}
+
+			endpoints[endpoint.URL] = true
+		case err := <-errs:
+			failure = err
+		}
+	}
+
+	// CLEANUP
+	for _, instance := range started {
+		_ = instance.Close()
+	}
+
+	// ASSERT
+	if failure != nil {
+		t.Fatalf("unexpected error starting instances in parallel: %s", failure)
+	}
+
+	if len(endpoints) != count {
+		t.Fatalf("expected %d distinct s3 endpoints, got %d", count, len(endpoints))
+	}
+}
+
+func Test_InitScripts(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+	bucket := "init-bucket"
+	script := fmt.Sprintf("#!/bin/bash\nawslocal s3 mb s3://%s\n", bucket)
+
+	dir, err := ioutil.TempDir("", "localstack-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "create-bucket.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := localstack.New(localstack.WithInitScripts(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.Wait(20 * time.Second); err != nil {
+		_ = instance.Close()
+		t.Fatal(err)
+	}
+
+	s3client := s3.New(instance.Config())
+	s3client.ForcePathStyle = true
+
+	headInput := s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	}
+
+	// RUN
+	// init scripts run once localstack is up, so give them a moment to finish
+	var headErr error
+	for attempt := 0; attempt < 20; attempt++ {
+		if _, headErr = s3client.HeadBucketRequest(&headInput).Send(ctx); headErr == nil {
+			break
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// ASSERT
+	if headErr != nil {
+		_ = instance.Close()
+		t.Fatalf("bucket created by the init script should exist: %s", headErr)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_Reset(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+
+	instance, err := localstack.New(localstack.WithServices(localstack.ServiceSQS, localstack.ServiceDynamoDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.Wait(20 * time.Second); err != nil {
+		_ = instance.Close()
+		t.Fatal(err)
+	}
+
+	s3client := s3.New(instance.Config())
+	s3client.ForcePathStyle = true
+	sqsClient := sqs.New(instance.Config())
+	dynamoClient := dynamodb.New(instance.Config())
+
+	bucketInput := s3.CreateBucketInput{Bucket: aws.String("reset-bucket")}
+	if _, err := s3client.CreateBucketRequest(&bucketInput).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	putInput := s3.PutObjectInput{
+		Bucket: aws.String("reset-bucket"),
+		Key:    aws.String("key"),
+		Body:   bytes.NewReader([]byte("content")),
+	}
+	if _, err := s3client.PutObjectRequest(&putInput).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error creating object: %s", err)
+	}
+
+	queueInput := sqs.CreateQueueInput{QueueName: aws.String("reset_queue")}
+	if _, err := sqsClient.CreateQueueRequest(&queueInput).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error creating queue: %s", err)
+	}
+
+	tableInput := dynamodb.CreateTableInput{
+		TableName: aws.String("reset_table"),
+		KeySchema: []dynamodb.KeySchemaElement{
+			{KeyType: dynamodb.KeyTypeHash, AttributeName: aws.String("id")},
+		},
+		AttributeDefinitions: []dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: dynamodb.ScalarAttributeTypeS},
+		},
+		BillingMode: dynamodb.BillingModePayPerRequest,
+	}
+	if _, err := dynamoClient.CreateTableRequest(&tableInput).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error creating table: %s", err)
+	}
+
+	// RUN
+	if err := instance.Reset(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error resetting instance: %s", err)
+	}
+
+	// ASSERT
+	buckets, err := s3client.ListBucketsRequest(&s3.ListBucketsInput{}).Send(ctx)
+	if err != nil || len(buckets.Buckets) != 0 {
+		_ = instance.Close()
+		t.Fatalf("buckets should be removed by Reset: %v", err)
+	}
+
+	queues, err := sqsClient.ListQueuesRequest(&sqs.ListQueuesInput{}).Send(ctx)
+	if err != nil || len(queues.QueueUrls) != 0 {
+		_ = instance.Close()
+		t.Fatalf("queues should be removed by Reset: %v", err)
+	}
+
+	tables, err := dynamoClient.ListTablesRequest(&dynamodb.ListTablesInput{}).Send(ctx)
+	if err != nil || len(tables.TableNames) != 0 {
+		_ = instance.Close()
+		t.Fatalf("tables should be removed by Reset: %v", err)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_WaitForServices(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+
+	instance, err := localstack.New(localstack.WithServices(localstack.ServiceS3, localstack.ServiceSQS, localstack.ServiceDynamoDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RUN
+	if err := instance.WaitForServices(30 * time.Second); err != nil {
+		_ = instance.Close()
+		t.Fatal(err)
+	}
+
+	// ASSERT
+	s3client := s3.New(instance.Config())
+	s3client.ForcePathStyle = true
+	if _, err := s3client.ListBucketsRequest(&s3.ListBucketsInput{}).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("s3 should be ready: %s", err)
+	}
+
+	if _, err := sqs.New(instance.Config()).ListQueuesRequest(&sqs.ListQueuesInput{}).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("sqs should be ready: %s", err)
+	}
+
+	if _, err := dynamodb.New(instance.Config()).ListTablesRequest(&dynamodb.ListTablesInput{}).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("dynamodb should be ready: %s", err)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_WithPool(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+
+	pool, err := localstack.SharedPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := localstack.New(localstack.WithPool(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := localstack.New(localstack.WithPool(pool))
+	if err != nil {
+		_ = first.Close()
+		t.Fatal(err)
+	}
+
+	if err := first.Wait(20 * time.Second); err != nil {
+		_ = first.Close()
+		_ = second.Close()
+		t.Fatal(err)
+	}
+
+	if err := second.Wait(20 * time.Second); err != nil {
+		_ = first.Close()
+		_ = second.Close()
+		t.Fatal(err)
+	}
+
+	// RUN
+	closeErr := first.Close()
+
+	// ASSERT
+	if closeErr != nil {
+		_ = second.Close()
+		t.Fatalf("unexpected error closing the first instance: %s", closeErr)
+	}
+
+	if !second.Ready(ctx) {
+		_ = second.Close()
+		t.Fatalf("closing one instance should leave the other running")
+	}
+
+	// CLEANUP
+	_ = second.Close()
+}
+
+func Test_StartupHook(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+	bucket := "hook-bucket"
+
+	hook := func(ctx context.Context, i *localstack.Instance) error {
+		client := s3.New(i.Config())
+		client.ForcePathStyle = true
+		_, err := client.CreateBucketRequest(&s3.CreateBucketInput{Bucket: aws.String(bucket)}).Send(ctx)
+		return err
+	}
+
+	// RUN
+	instance, err := localstack.New(localstack.WithStartupHook(hook), localstack.WithStartupTimeout(20*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ASSERT
+	s3client := s3.New(instance.Config())
+	s3client.ForcePathStyle = true
+	if _, err := s3client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)}).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("bucket created by the startup hook should exist: %s", err)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_ExecAwslocal(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+	instance, err := localstack.New(localstack.WithStartupTimeout(20 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RUN
+	if _, stderr, err := instance.Exec(ctx, "awslocal", "s3", "mb", "s3://x"); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error running awslocal: %s: %s", err, stderr)
+	}
+
+	// ASSERT
+	s3client := s3.New(instance.Config())
+	s3client.ForcePathStyle = true
+	if _, err := s3client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String("x")}).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("bucket made with awslocal should exist: %s", err)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_CopyToContainer(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "localstack-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "fixture.txt")
+	if err := ioutil.WriteFile(src, []byte("hello, container!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := localstack.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RUN
+	if err := instance.CopyTo(ctx, src, "/tmp/fixture.txt"); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error copying file: %s", err)
+	}
+
+	stdout, stderr, err := instance.Exec(ctx, "cat", "/tmp/fixture.txt")
+
+	// ASSERT
+	if err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error reading copied file: %s: %s", err, stderr)
+	}
+
+	if stdout != "hello, container!" {
+		_ = instance.Close()
+		t.Fatalf("expected the copied file's content, got %q", stdout)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_S3VirtualHost(t *testing.T) {
+	// SETUP
+	if _, err := net.LookupHost("virtual-bucket.s3.localhost.localstack.cloud"); err != nil {
+		t.Skipf("virtual-hosted-style S3 needs DNS for localhost.localstack.cloud: %s", err)
+	}
+
+	ctx := context.TODO()
+	bucket := "virtual-bucket"
+	instance, err := localstack.New(localstack.WithS3VirtualHost(), localstack.WithStartupTimeout(20*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := instance.S3Client()
+
+	// RUN
+	if _, err := client.CreateBucketRequest(&s3.CreateBucketInput{Bucket: aws.String(bucket)}).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error creating bucket: %s", err)
+	}
+
+	_, err = client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)}).Send(ctx)
+
+	// ASSERT
+	if err != nil {
+		_ = instance.Close()
+		t.Fatalf("bucket should be reachable through its virtual host: %s", err)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}
+
+func Test_Kinesis(t *testing.T) {
+	// SETUP
+	ctx := context.TODO()
+	stream := "test-stream"
+	instance, err := localstack.New(localstack.WithServices(localstack.ServiceKinesis), localstack.WithStartupTimeout(20*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := instance.KinesisClient()
+	createInput := kinesis.CreateStreamInput{
+		StreamName: aws.String(stream),
+		ShardCount: aws.Int64(1),
+	}
+
+	// RUN
+	if _, err := client.CreateStreamRequest(&createInput).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("unexpected error creating stream: %s", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	err = instance.WaitForStream(waitCtx, stream)
+
+	// ASSERT
+	if err != nil {
+		_ = instance.Close()
+		t.Fatal(err)
+	}
+
+	putInput := kinesis.PutRecordInput{
+		StreamName:   aws.String(stream),
+		PartitionKey: aws.String("key"),
+		Data:         []byte("hello, stream!"),
+	}
+	if _, err := client.PutRecordRequest(&putInput).Send(ctx); err != nil {
+		_ = instance.Close()
+		t.Fatalf("an active stream should accept records: %s", err)
+	}
+
+	// CLEANUP
+	_ = instance.Close()
+}